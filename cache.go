@@ -0,0 +1,340 @@
+package magnet
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// cacheGCInterval specifies how often the cache is collected automatically at Root
+const cacheGCInterval = 24 * time.Hour
+
+// cacheGCMarker names the file in the cache directory that records the time of the last collection
+const cacheGCMarker = ".gc"
+
+// cacheTempGracePeriod specifies the age after which entries being assembled
+// are considered leftovers of an interrupted download, extraction or clone
+const cacheTempGracePeriod = time.Hour
+
+// cacheSuffixes lists the suffixes of the auxiliary files of a cache entry
+var cacheSuffixes = []string{".partial.wcache", ".wcache", ".partial", ".lock"}
+
+// cacheTempMarker marks the names of entries that are being assembled
+// (e.g. archives being extracted or repositories being cloned)
+const cacheTempMarker = ".tmp"
+
+// CacheCategoryUsage describes the disk usage of a single cache category
+// (e.g. dl for downloads or go for the Go build and module cache)
+type CacheCategoryUsage struct {
+	// Category names the category
+	Category string
+	// Entries specifies the number of entries in the category
+	Entries int
+	// Size specifies the total size of the entries in bytes
+	Size int64
+	// LastAccessed specifies the most recent access time of an entry in the category
+	LastAccessed time.Time
+}
+
+// CacheGCResult describes the outcome of a cache collection
+type CacheGCResult struct {
+	// Entries specifies the number of removed entries
+	Entries int
+	// Size specifies the total size of the removed entries in bytes
+	Size int64
+}
+
+// cacheEntry describes a single cache entry.
+// An entry consists of the file or directory along with its auxiliary files
+// (metadata, partial downloads and locks)
+type cacheEntry struct {
+	category string
+	// paths lists the files of the entry except the lock file
+	paths    []string
+	lockPath string
+	// temp specifies whether the entry is being assembled
+	temp bool
+	size int64
+	// accessed specifies the last access time of the entry
+	// as the most recent modification time of any file in the entry
+	accessed time.Time
+}
+
+// CacheUsage reports the disk usage of the cache by category.
+// See Magnet.CacheUsage for details
+func CacheUsage() ([]CacheCategoryUsage, error) {
+	if root == nil {
+		return nil, trace.NotFound("magnet is not initialized")
+	}
+	return root.CacheUsage()
+}
+
+// CacheGC removes cache entries exceeding the configured age and size limits.
+// See Magnet.CacheGC for details
+func CacheGC(ctx context.Context) (*CacheGCResult, error) {
+	if root == nil {
+		return nil, trace.NotFound("magnet is not initialized")
+	}
+	return root.CacheGC(ctx)
+}
+
+// CacheUsage reports the disk usage of the cache by category sorted by name
+func (m *Magnet) CacheUsage() ([]CacheCategoryUsage, error) {
+	entries, err := m.cacheEntries()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	usage := make(map[string]*CacheCategoryUsage)
+	for _, e := range entries {
+		u, ok := usage[e.category]
+		if !ok {
+			u = &CacheCategoryUsage{Category: e.category}
+			usage[e.category] = u
+		}
+		u.Entries++
+		u.Size += e.size
+		if e.accessed.After(u.LastAccessed) {
+			u.LastAccessed = e.accessed
+		}
+	}
+	result := make([]CacheCategoryUsage, 0, len(usage))
+	for _, u := range usage {
+		result = append(result, *u)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Category < result[j].Category
+	})
+	return result, nil
+}
+
+// CacheGC removes cache entries not accessed for longer than Config.CacheMaxAge and
+// then the least recently used entries until the cache is smaller than Config.CacheMaxSize.
+// Entries locked by a download in progress are skipped. Entries being assembled are
+// skipped for cacheTempGracePeriod and removed as leftovers afterwards.
+// The Go build and module caches are collected as whole subtrees of the go category
+// (e.g. a bucket of the build cache or the module cache).
+// The cache is collected automatically at Root at most once per cacheGCInterval
+func (m *Magnet) CacheGC(ctx context.Context) (*CacheGCResult, error) {
+	entries, err := m.cacheEntries()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].accessed.Before(entries[j].accessed)
+	})
+
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+
+	result := &CacheGCResult{}
+	now := time.Now()
+	var errors []error
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return result, trace.Wrap(ctx.Err())
+		}
+		if e.temp {
+			if now.Sub(e.accessed) <= cacheTempGracePeriod {
+				continue
+			}
+		} else {
+			expired := m.CacheMaxAge > 0 && now.Sub(e.accessed) > m.CacheMaxAge
+			oversized := m.CacheMaxSize > 0 && total > m.CacheMaxSize
+			if !expired && !oversized {
+				// entries are sorted by access time so the remaining entries are newer,
+				// only stale entries being assembled remain to be collected
+				continue
+			}
+		}
+		removed, err := e.remove()
+		if err != nil {
+			errors = append(errors, trace.Wrap(err))
+		}
+		if !removed {
+			continue
+		}
+		total -= e.size
+		result.Entries++
+		result.Size += e.size
+	}
+	return result, trace.NewAggregate(errors...)
+}
+
+// collectCache runs the cache collection if it has not run within cacheGCInterval.
+// The time of the collection is recorded before it starts so that concurrent
+// builds sharing the cache do not collect it at the same time
+func (m *Magnet) collectCache(ctx context.Context) error {
+	marker := filepath.Join(m.cacheDir(), cacheGCMarker)
+	if fi, err := os.Stat(marker); err == nil && time.Since(fi.ModTime()) < cacheGCInterval {
+		return nil
+	}
+	if err := os.MkdirAll(m.cacheDir(), 0755); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	touchCache(marker)
+	_, err := m.CacheGC(ctx)
+	return trace.Wrap(err)
+}
+
+// cacheEntries lists the entries in all cache categories.
+// Categories are the top-level directories in the cache directory
+func (m *Magnet) cacheEntries() (entries []*cacheEntry, err error) {
+	dir := m.cacheDir()
+	categories, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, trace.ConvertSystemError(err)
+	}
+	for _, category := range categories {
+		if !category.IsDir() {
+			continue
+		}
+		result, err := listCacheEntries(filepath.Join(dir, category.Name()), category.Name())
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		entries = append(entries, result...)
+	}
+	return entries, nil
+}
+
+func listCacheEntries(dir, category string) ([]*cacheEntry, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	entries := make(map[string]*cacheEntry)
+	var names []string
+	for _, fi := range files {
+		name := cacheEntryName(fi.Name())
+		e, ok := entries[name]
+		if !ok {
+			e = &cacheEntry{category: category, temp: strings.Contains(name, cacheTempMarker)}
+			entries[name] = e
+			names = append(names, name)
+		}
+		path := filepath.Join(dir, fi.Name())
+		if strings.HasSuffix(fi.Name(), ".lock") {
+			// lock files are kept so that waiters keep locking the same file
+			e.lockPath = path
+			continue
+		}
+		e.paths = append(e.paths, path)
+		if err := e.stat(path); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+	result := make([]*cacheEntry, 0, len(names))
+	for _, name := range names {
+		if len(entries[name].paths) != 0 {
+			result = append(result, entries[name])
+		}
+	}
+	return result, nil
+}
+
+// cacheEntryName returns the name of the entry the file with the given name belongs to
+func cacheEntryName(name string) string {
+	for _, suffix := range cacheSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
+
+// stat accounts for the size and modification time of all files at path
+func (r *cacheEntry) stat(path string) error {
+	err := filepath.Walk(path, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return trace.ConvertSystemError(err)
+		}
+		if fi.Mode().IsRegular() {
+			r.size += fi.Size()
+		}
+		if fi.ModTime().After(r.accessed) {
+			r.accessed = fi.ModTime()
+		}
+		return nil
+	})
+	return trace.Wrap(err)
+}
+
+// remove removes all files of the entry except the lock file.
+// Returns false if the entry is in use
+func (r *cacheEntry) remove() (removed bool, err error) {
+	if r.lockPath != "" {
+		f, err := os.OpenFile(r.lockPath, os.O_RDWR, 0644)
+		if err == nil {
+			defer f.Close()
+			ok, err := tryLockFile(f)
+			if err != nil || !ok {
+				return false, trace.Wrap(err)
+			}
+			defer unlockFile(f) //nolint:errcheck
+		}
+	}
+	var errors []error
+	for _, path := range r.paths {
+		if err := removeAll(path); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	return true, trace.NewAggregate(errors...)
+}
+
+// removeAll removes path and its contents.
+// Read-only directories (e.g. in the Go module cache) are made writable first
+func removeAll(path string) error {
+	_ = filepath.Walk(path, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() && fi.Mode().Perm()&0200 == 0 {
+			_ = os.Chmod(path, fi.Mode().Perm()|0200)
+		}
+		return nil
+	})
+	return trace.ConvertSystemError(os.RemoveAll(path))
+}
+
+// touchCache records the access to the cache entry at path
+func touchCache(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
+
+// parseSize parses the size in bytes with an optional binary unit suffix (e.g. 512M or 10GiB)
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	value := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	var multiplier int64 = 1
+	if len(value) > 0 {
+		if i := strings.IndexByte("KMGT", value[len(value)-1]); i >= 0 {
+			multiplier = 1 << (10 * uint(i+1))
+			value = value[:len(value)-1]
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, trace.BadParameter("expected a size (e.g. 512M or 10G), got %q", s)
+	}
+	return n * multiplier, nil
+}
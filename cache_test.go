@@ -0,0 +1,72 @@
+package magnet
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheGC(t *testing.T) {
+	target, cleanup := newTestTarget(t, Config{})
+	defer cleanup()
+	m := target.root
+
+	now := time.Now()
+	writeEntry := func(path string, size int, accessed time.Time) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, make([]byte, size), 0644))
+		require.NoError(t, os.Chtimes(path, accessed, accessed))
+		// directories within the category count as accessed when their files are written
+		for dir := filepath.Dir(path); filepath.Dir(dir) != m.cacheDir(); dir = filepath.Dir(dir) {
+			require.NoError(t, os.Chtimes(dir, accessed, accessed))
+		}
+	}
+	writeEntry(filepath.Join(m.cacheDir(), "dl", "expired"), 10, now.Add(-48*time.Hour))
+	writeEntry(filepath.Join(m.cacheDir(), "dl", "old"), 100, now.Add(-2*time.Hour))
+	writeEntry(filepath.Join(m.cacheDir(), "dl", "old.wcache"), 10, now.Add(-2*time.Hour))
+	writeEntry(filepath.Join(m.cacheDir(), "dl", "recent"), 100, now.Add(-time.Hour))
+	writeEntry(filepath.Join(m.cacheDir(), "go", "00", "entry"), 50, now)
+	// lock files and recent entries being assembled are never removed
+	writeEntry(filepath.Join(m.cacheDir(), "dl", "old.lock"), 0, now.Add(-2*time.Hour))
+	writeEntry(filepath.Join(m.cacheDir(), "extract", "key.tmp123", "file"), 10, now.Add(-48*time.Hour))
+	writeEntry(filepath.Join(m.cacheDir(), "extract", "other.tmp456", "file"), 10, now)
+	writeEntry(filepath.Join(m.cacheDir(), "go", "pkg", "mod", "module"), 10, now.Add(-48*time.Hour))
+
+	usage, err := m.CacheUsage()
+	require.NoError(t, err)
+	require.Len(t, usage, 3)
+	require.Equal(t, "dl", usage[0].Category)
+	require.Equal(t, 3, usage[0].Entries)
+	require.Equal(t, int64(220), usage[0].Size)
+	require.Equal(t, "extract", usage[1].Category)
+	require.Equal(t, int64(20), usage[1].Size)
+	require.Equal(t, "go", usage[2].Category)
+	require.Equal(t, int64(60), usage[2].Size)
+
+	m.CacheMaxAge = 24 * time.Hour
+	m.CacheMaxSize = 200
+	result, err := m.CacheGC(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, &CacheGCResult{Entries: 4, Size: 140}, result)
+
+	for _, path := range []string{"dl/expired", "dl/old", "dl/old.wcache", "extract/key.tmp123", "go/pkg"} {
+		_, err := os.Stat(filepath.Join(m.cacheDir(), path))
+		require.True(t, os.IsNotExist(err), path)
+	}
+	for _, path := range []string{"dl/recent", "dl/old.lock", "extract/other.tmp456/file", "go/00/entry"} {
+		_, err = os.Stat(filepath.Join(m.cacheDir(), path))
+		require.NoError(t, err, path)
+	}
+
+	// the automatic collection runs at most once per interval
+	require.NoError(t, m.collectCache(context.TODO()))
+	writeEntry(filepath.Join(m.cacheDir(), "dl", "expired"), 10, now.Add(-48*time.Hour))
+	require.NoError(t, m.collectCache(context.TODO()))
+	_, err = os.Stat(filepath.Join(m.cacheDir(), "dl", "expired"))
+	require.NoError(t, err)
+}
@@ -14,13 +14,17 @@ limitations under the License.
 package common
 
 import (
+	"context"
+	"fmt"
 	"os"
-	"sort"
+	"time"
 
 	"github.com/gravitational/magnet"
+	"github.com/gravitational/trace"
 
 	"github.com/magefile/mage/mg"
 	"github.com/olekukonko/tablewriter"
+	"github.com/tonistiigi/units"
 )
 
 // Help defines the utility namespace for help targets
@@ -28,27 +32,118 @@ type Help mg.Namespace
 
 // Envs outputs the current environment configuration
 func (Help) Envs() (err error) {
-	var result [][]string
+	return trace.Wrap(magnet.WriteEnv(os.Stdout, magnet.EnvFormatTable))
+}
 
-	for key, value := range magnet.Env() {
-		if value.Secret {
-			result = append(result, []string{key, "<redacted>", "", value.Short})
-		} else {
-			result = append(result, []string{key, value.Value, value.Default, value.Short})
-		}
+// EnvsFormat outputs the current environment configuration in the specified format
+// (table, json, markdown, shell or github)
+func (Help) EnvsFormat(format string) (err error) {
+	return trace.Wrap(magnet.WriteEnv(os.Stdout, format))
+}
+
+// EnvsExport writes the current environment configuration in the specified format to the file at path.
+// The github format is appended to the file (as expected for $GITHUB_ENV), other formats replace its contents
+func (Help) EnvsExport(format, path string) (err error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if format == magnet.EnvFormatGithub {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	defer f.Close()
+	if err := magnet.WriteEnv(f, format); err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.ConvertSystemError(f.Close())
+}
+
+// EnvDiff compares the environment snapshots of two runs.
+// Arguments are either paths to the log directories of the runs (e.g. build/logs/20201020134501)
+// or paths to the snapshot files
+func (Help) EnvDiff(old, new string) (err error) {
+	oldSnapshot, err := magnet.LoadEnvSnapshot(old)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	newSnapshot, err := magnet.LoadEnvSnapshot(new)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	changes := magnet.DiffEnvSnapshots(oldSnapshot, newSnapshot)
+	if len(changes) == 0 {
+		fmt.Println("No changes.")
+		return nil
 	}
-	sort.SliceStable(result, func(i, j int) bool {
-		return result[i][0] < result[j][0]
-	})
 
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"Env", "Value", "Default", "Short Description"})
+	table.SetHeader([]string{"Env", "Old Value", "Old Source", "New Value", "New Source"})
 	table.SetBorder(false)
 	table.SetAutoWrapText(false)
 	table.SetReflowDuringAutoWrap(false)
 
-	table.AppendBulk(result)
+	for _, change := range changes {
+		row := []string{change.Key, "<unset>", "", "<unset>", ""}
+		if change.Old != nil {
+			row[1], row[2] = change.Old.Value, change.Old.Source
+		}
+		if change.New != nil {
+			row[3], row[4] = change.New.Value, change.New.Source
+		}
+		table.Append(row)
+	}
 	table.Render()
 
 	return nil
 }
+
+// Cache defines the utility namespace for cache maintenance targets
+type Cache mg.Namespace
+
+// Usage outputs the disk usage of the cache by category
+func (Cache) Usage() (err error) {
+	usage, err := magnet.CacheUsage()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Category", "Entries", "Size", "Last Accessed"})
+	table.SetBorder(false)
+
+	var total int64
+	for _, u := range usage {
+		total += u.Size
+		table.Append([]string{
+			u.Category,
+			fmt.Sprint(u.Entries),
+			fmt.Sprintf("%.2f", units.Bytes(u.Size)),
+			u.LastAccessed.Format(time.RFC3339),
+		})
+	}
+	table.SetFooter([]string{"", "Total", fmt.Sprintf("%.2f", units.Bytes(total)), ""})
+	table.Render()
+
+	return nil
+}
+
+// GC removes cache entries exceeding the configured limits (CACHE_MAX_SIZE and CACHE_MAX_AGE)
+func (Cache) GC(ctx context.Context) (err error) {
+	result, err := magnet.CacheGC(ctx)
+	if result != nil {
+		fmt.Printf("Removed %v entries (%.2f).\n", result.Entries, units.Bytes(result.Size))
+	}
+	return trace.Wrap(err)
+}
+
+// Download defines the utility namespace for download maintenance targets
+type Download mg.Namespace
+
+// RefreshLock downloads all files recorded in the download lock file (Config.DownloadLockFile)
+// and records their new digests.
+// Use this to deliberately accept changes in upstream artifacts
+func (Download) RefreshLock(ctx context.Context) (err error) {
+	return trace.Wrap(magnet.RefreshDownloadLock(ctx))
+}
@@ -3,6 +3,7 @@ package magnet
 import (
 	"context"
 	"crypto/sha256"
+	_ "crypto/sha512" // register sha512 for digest verification
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gravitational/magnet/pkg/progressui"
@@ -19,13 +21,96 @@ import (
 )
 
 type downloadMetadata struct {
-	ETag    string
-	SHA2Sum string
+	ETag         string
+	LastModified string `yaml:",omitempty"`
+	SHA2Sum      string
+	// SignatureKeyID identifies the key of the verified detached signature
+	SignatureKeyID string `yaml:",omitempty"`
+}
+
+// validator returns the value for the If-Range header to resume the download with.
+// Weak ETags cannot be used for range requests
+func (r downloadMetadata) validator() string {
+	if r.ETag != "" && !strings.HasPrefix(r.ETag, "W/") {
+		return r.ETag
+	}
+	return r.LastModified
+}
+
+// DownloadConfig holds configuration for downloading a file.
+type DownloadConfig struct {
+	target *MagnetTarget
+
+	// Digest optionally specifies the expected digest of the file
+	// in the <algorithm>:<hex> format. sha256 and sha512 are supported.
+	// Takes precedence over the digest recorded in the download lock file.
+	Digest string
+
+	// StripComponents specifies the number of leading path components
+	// to strip from archive entries on extraction.
+	StripComponents int
+
+	// Include optionally lists patterns of archive entries to extract.
+	Include []string
+
+	// ArchiveFormat optionally specifies the format of the archive to extract.
+	// Detected from the URL if unspecified.
+	ArchiveFormat string
+
+	// SignatureURL optionally specifies the URL of the detached signature of the file.
+	SignatureURL string
+
+	// SignatureKeys lists the paths to the trusted public keys to verify the signature with.
+	SignatureKeys []string
+
+	// HTTP optionally configures the HTTP client for this download.
+	// Unset fields default to Config.DownloadHTTP.
+	HTTP HTTPConfig
+
+	// refreshLock specifies whether to replace the digest recorded in the download lock file
+	refreshLock bool
+}
+
+// Downloader creates a builder for downloading files with additional configuration.
+func (m *MagnetTarget) Downloader() *DownloadConfig {
+	return &DownloadConfig{
+		target: m,
+	}
+}
+
+// SetDigest sets the expected digest of the file in the <algorithm>:<hex> format (e.g. sha256:e3b0c4...).
+func (c *DownloadConfig) SetDigest(digest string) *DownloadConfig {
+	c.Digest = digest
+	return c
+}
+
+// SetSHA256 sets the expected sha256 checksum of the file as a hex string.
+func (c *DownloadConfig) SetSHA256(sum string) *DownloadConfig {
+	c.Digest = string(digest.NewDigestFromEncoded(digest.SHA256, sum))
+	return c
+}
+
+// SetSHA512 sets the expected sha512 checksum of the file as a hex string.
+func (c *DownloadConfig) SetSHA512(sum string) *DownloadConfig {
+	c.Digest = string(digest.NewDigestFromEncoded(digest.SHA512, sum))
+	return c
 }
 
 // DownloadFuture begins a download of a url but doesn't block.
 // Returns a future that when called will block until it can return the path to the file on disk or an error.
 func (m *MagnetTarget) DownloadFuture(ctx context.Context, url string) DownloadFutureFunc {
+	return m.Downloader().DownloadFuture(ctx, url)
+}
+
+// Download will download a file from a remote URL. It's optimized for working with a local cache, and will send
+// request headers to the upstream server and only download the file if cached or missing from the local cache.
+func (m *MagnetTarget) Download(ctx context.Context, url string) (path string, err error) {
+	return m.Downloader().Download(ctx, url)
+}
+
+// DownloadFuture begins a download of a url but doesn't block.
+// Returns a future that when called will block until it can return the path to the file on disk or an error.
+func (c *DownloadConfig) DownloadFuture(ctx context.Context, url string) DownloadFutureFunc {
 	type result struct {
 		path string
 		err  error
@@ -33,11 +118,11 @@ func (m *MagnetTarget) DownloadFuture(ctx context.Context, url string) DownloadF
 	resultC := make(chan result, 1)
 
 	go func() {
-		p, err := m.Download(ctx, url)
+		p, err := c.Download(ctx, url)
 		resultC <- result{path: p, err: err}
 	}()
 
-	return func() (url, path string, err error) {
+	return func() (string, string, error) {
 		result := <-resultC
 		if result.err != nil {
 			return url, "", trace.Wrap(result.err)
@@ -48,14 +133,63 @@ func (m *MagnetTarget) DownloadFuture(ctx context.Context, url string) DownloadF
 
 // Download will download a file from a remote URL. It's optimized for working with a local cache, and will send
 // request headers to the upstream server and only download the file if cached or missing from the local cache.
-func (m *MagnetTarget) Download(ctx context.Context, url string) (path string, err error) {
+//
+// If the expected digest is known (either configured explicitly or recorded in the download lock file),
+// the file is verified against it and the download fails on mismatch.
+// A cached file matching the expected digest is used without contacting the upstream server.
+//
+// Download URLs are rewritten and mirrors are tried as configured with Config.DownloadRewrites
+// and Config.DownloadMirrors. In offline mode, files are served only from the cache.
+//
+// Interrupted downloads are kept in a separate partial file and resumed with a range request
+// if the server supports it and the file hasn't changed upstream.
+//
+// The number of concurrent downloads is limited by Config.DownloadConcurrency.
+// Concurrent downloads of the same file are deduplicated within the process
+// and serialized across processes sharing the cache directory.
+func (c *DownloadConfig) Download(ctx context.Context, url string) (path string, err error) {
+	path = c.target.root.downloadPath(url)
+	key := fmt.Sprintf("%v@%v@%v", url, c.Digest, c.SignatureURL)
+	if c.refreshLock {
+		key += "@refresh"
+	}
+	path, err = c.target.root.downloads().do(ctx, key, fmt.Sprintf("%v.lock", path), func() (string, error) {
+		path, err := c.download(ctx, url)
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+		if err := c.verifySignature(ctx, url, path); err != nil {
+			return "", trace.Wrap(err)
+		}
+		// only record files that have passed all checks
+		return path, trace.Wrap(c.recordDigest(ctx, url, path))
+	})
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	touchCache(metadataPath(path))
+	return path, nil
+}
+
+// downloadPath returns the path to the cached file for url
+func (m *Magnet) downloadPath(url string) string {
+	return filepath.Join(m.cacheDir(), "dl", digest.FromString(url).String())
+}
+
+func (c *DownloadConfig) download(ctx context.Context, url string) (path string, err error) {
+	m := c.target
 	progress := dlProgressWriter{
 		m:   m,
 		url: url,
 	}
 	progress.Init()
 
-	path = filepath.Join(m.root.cacheDir(), "dl", digest.FromString(url).String())
+	expected, err := c.expectedDigest(url)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	path = m.root.downloadPath(url)
 
 	metadata, err := getMetadata(path)
 	if err != nil && !trace.IsNotFound(err) {
@@ -68,7 +202,38 @@ func (m *MagnetTarget) Download(ctx context.Context, url string) (path string, e
 		metadata = downloadMetadata{}
 	}
 
-	resp, err := httpGetRequest(ctx, url, metadata.ETag)
+	// a pinned file in the cache doesn't need to be revalidated with upstream
+	if expected != "" && metadata.SHA2Sum != "" && verifyDigest(path, metadata, expected) == nil {
+		progress.Complete()
+		return path, nil
+	}
+
+	if m.root.DownloadOffline {
+		if metadata.SHA2Sum == "" {
+			return "", trace.NotFound("%v is not cached and downloads are disabled in offline mode", url)
+		}
+		if err := c.verify(url, path, metadata, expected); err != nil {
+			return "", trace.Wrap(err)
+		}
+		progress.Complete()
+		return path, nil
+	}
+
+	// resume a previously interrupted download if possible
+	partialPath := partialPath(path)
+	partial, offset := getPartialMetadata(partialPath)
+
+	header := make(http.Header)
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+		header.Set("If-Range", partial.validator())
+	} else if metadata.ETag != "" {
+		header.Set("If-None-Match", metadata.ETag)
+	} else if metadata.LastModified != "" {
+		header.Set("If-Modified-Since", metadata.LastModified)
+	}
+
+	resp, err := c.get(ctx, url, header)
 	if err != nil {
 		return "", trace.Wrap(err)
 	}
@@ -77,58 +242,188 @@ func (m *MagnetTarget) Download(ctx context.Context, url string) (path string, e
 		_ = resp.Body.Close()
 	}()
 
-	if resp.StatusCode == http.StatusNotModified {
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if err := c.verify(url, path, metadata, expected); err != nil {
+			return "", trace.Wrap(err)
+		}
 		progress.Complete()
 		return path, nil
+	case http.StatusPartialContent:
+		if start, _ := parseContentRange(resp.Header.Get("Content-Range")); start != offset {
+			removePartial(partialPath)
+			return "", trace.BadParameter("unexpected Content-Range %q for offset %v",
+				resp.Header.Get("Content-Range"), offset).AddField("url", url)
+		}
+		m.Printlnf("Resuming download at offset %v.", offset)
+	case http.StatusOK:
+		// the server either doesn't support ranges or the file has changed
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		removePartial(partialPath)
+		if offset == 0 {
+			return "", trace.BadParameter("Unexpected status code: %v", resp.StatusCode).AddField("url", url)
+		}
+		// the partial file does not match upstream anymore: restart the download.
+		// Without the partial file the request has no range, so this is only retried once
+		m.Printlnf("Failed to resume download at offset %v, restarting.", offset)
+		return c.download(ctx, url)
+	default:
+		return "", trace.BadParameter("Unexpected status code: %v", resp.StatusCode).AddField("url", url)
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", trace.BadParameter("Unexpected status code: %v", resp.StatusCode).AddField("url", url)
+	metadata, err = c.fetch(resp, partialPath, offset, &progress)
+	if err != nil {
+		return "", trace.Wrap(err).AddField("url", url)
 	}
 
-	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err := c.verify(url, partialPath, metadata, expected); err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	err = os.Rename(partialPath, path)
 	if err != nil {
-		return "", trace.Wrap(err).AddField("path", filepath.Dir(path))
+		return "", trace.ConvertSystemError(err)
 	}
+	_ = os.Remove(metadataPath(partialPath))
 
-	out, err := os.Create(path)
+	err = writeMetadata(metadata, path)
 	if err != nil {
 		return "", trace.Wrap(err).AddField("path", path)
 	}
 
+	progress.Complete()
+	return path, nil
+}
+
+// fetch writes the response body to the partial download file at path starting at offset.
+// The file is kept along with the response validators if the transfer is interrupted,
+// so the download can be resumed
+func (c *DownloadConfig) fetch(resp *http.Response, path string, offset int64, progress *dlProgressWriter) (metadata downloadMetadata, err error) {
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return metadata, trace.Wrap(err).AddField("path", filepath.Dir(path))
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	out, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return metadata, trace.Wrap(err).AddField("path", path)
+	}
+
 	defer func() {
 		_ = out.Close()
 	}()
 
+	hash := sha256.New()
+	if offset > 0 {
+		// account for the already downloaded part in the checksum
+		if err := hashFile(hash, path, offset); err != nil {
+			return metadata, trace.Wrap(err)
+		}
+	}
+
+	metadata = downloadMetadata{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if offset > 0 {
+		// keep the validators of the original response
+		metadata, _ = getMetadata(path)
+	}
+	if err := writeMetadata(metadata, path); err != nil {
+		return metadata, trace.Wrap(err).AddField("path", path)
+	}
+
 	// ignore errors, we don't care if we don't have the content-length
-	progress.total, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	length, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	progress.current = offset
+	progress.total = offset + length
+	if _, size := parseContentRange(resp.Header.Get("Content-Range")); size > 0 {
+		progress.total = size
+	}
 	progress.Init() // Redo Init once we know how much to download
 
-	m.Println("Total download: ", progress.total)
+	c.target.Println("Total download: ", progress.total)
 
 	// tee the file
 	// - calculate the checksum as the file is download for our metadata
 	// - report the download progress to our progress writer
 	reader := io.TeeReader(resp.Body, out)
-	reader = io.TeeReader(reader, &progress)
-
-	hash := sha256.New()
+	reader = io.TeeReader(reader, progress)
 
 	_, err = io.Copy(hash, reader)
 	if err != nil {
-		return "", trace.Wrap(err).AddField("url", url)
+		return metadata, trace.Wrap(err)
 	}
 
-	err = writeMetadata(downloadMetadata{
-		ETag:    resp.Header.Get("ETag"),
-		SHA2Sum: fmt.Sprintf("%x", hash.Sum(nil)),
-	}, path)
-	if err != nil {
-		return "", trace.Wrap(err).AddField("path", path)
+	if err := out.Close(); err != nil {
+		return metadata, trace.ConvertSystemError(err)
 	}
 
-	progress.Complete()
-	return path, nil
+	metadata.SHA2Sum = fmt.Sprintf("%x", hash.Sum(nil))
+	return metadata, nil
+}
+
+// expectedDigest returns the expected digest for the file at url.
+// Returns an empty digest if the digest is not known
+func (c *DownloadConfig) expectedDigest(url string) (digest.Digest, error) {
+	if c.Digest != "" {
+		d, err := parseDigest(c.Digest)
+		return d, trace.Wrap(err)
+	}
+	lock, err := c.target.root.downloadLock()
+	if err != nil || lock == nil || c.refreshLock {
+		return "", trace.Wrap(err)
+	}
+	return lock.get(url), nil
+}
+
+// verify verifies the downloaded file at path against the expected digest, if known.
+// Removes the file on mismatch so the next attempt will download it again
+func (c *DownloadConfig) verify(url, path string, metadata downloadMetadata, expected digest.Digest) error {
+	if expected == "" {
+		return nil
+	}
+
+	if err := verifyDigest(path, metadata, expected); err != nil {
+		_ = os.Remove(path)
+		_ = os.Remove(metadataPath(path))
+		return trace.Wrap(err).AddField("url", url)
+	}
+	return nil
+}
+
+// recordDigest records the digest of the downloaded file at path in the download lock file,
+// if configured and the digest is not known yet
+func (c *DownloadConfig) recordDigest(ctx context.Context, url, path string) error {
+	expected, err := c.expectedDigest(url)
+	if err != nil || expected != "" {
+		return trace.Wrap(err)
+	}
+	lock, err := c.target.root.downloadLock()
+	if err != nil || lock == nil {
+		return trace.Wrap(err)
+	}
+	metadata, err := getMetadata(path)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	actual := digest.NewDigestFromEncoded(digest.SHA256, metadata.SHA2Sum)
+	previous, err := lock.record(ctx, url, actual)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	switch {
+	case previous == "":
+		c.target.Printlnf("Recorded %v for %v in %v.", actual, url, lock.path)
+	case previous != actual:
+		c.target.Printlnf("Updated %v for %v in %v (was %v).", actual, url, lock.path, previous)
+	}
+	return nil
 }
 
 // DownloadFutureFunc defines the function type returned from the DownloadFuture API
@@ -195,24 +490,6 @@ func (d *dlProgressWriter) Write(data []byte) (int, error) {
 	return len(data), nil
 }
 
-func httpGetRequest(ctx context.Context, url, etag string) (*http.Response, error) {
-	client := &http.Client{}
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, trace.Wrap(err)
-	}
-	req = req.WithContext(ctx)
-
-	if etag != "" {
-		req.Header.Add("If-None-Match", etag)
-	}
-
-	resp, err := client.Do(req)
-
-	return resp, trace.Wrap(err)
-}
-
 func getMetadata(path string) (downloadMetadata, error) {
 	var result downloadMetadata
 
@@ -236,7 +513,7 @@ func writeMetadata(metadata downloadMetadata, path string) error {
 		return trace.Wrap(err)
 	}
 
-	return trace.Wrap(ioutil.WriteFile(metadataPath(path), buf, 0600))
+	return trace.Wrap(writeFileAtomic(metadataPath(path), buf, 0600))
 }
 
 func validateChecksum(path, checksum string) bool {
@@ -254,3 +531,85 @@ func validateChecksum(path, checksum string) bool {
 
 	return fmt.Sprintf("%x", hash.Sum(nil)) == checksum
 }
+
+// verifyDigest verifies the file at path against the expected digest.
+// The sha256 checksum from metadata is used if the digest algorithm is sha256
+func verifyDigest(path string, metadata downloadMetadata, expected digest.Digest) error {
+	actual := digest.NewDigestFromEncoded(digest.SHA256, metadata.SHA2Sum)
+	if expected.Algorithm() != digest.SHA256 || metadata.SHA2Sum == "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return trace.ConvertSystemError(err)
+		}
+		defer f.Close()
+		actual, err = expected.Algorithm().FromReader(f)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	if actual != expected {
+		return trace.CompareFailed("checksum mismatch: expected %v, got %v", expected, actual)
+	}
+	return nil
+}
+
+func parseDigest(s string) (digest.Digest, error) {
+	d, err := digest.Parse(s)
+	if err != nil {
+		return "", trace.BadParameter("invalid digest %q: %v", s, err)
+	}
+	switch d.Algorithm() {
+	case digest.SHA256, digest.SHA512:
+		return d, nil
+	}
+	return "", trace.BadParameter("unsupported digest algorithm %q, expected sha256 or sha512", d.Algorithm())
+}
+
+func partialPath(path string) string {
+	return fmt.Sprintf("%v.partial", path)
+}
+
+// getPartialMetadata returns the metadata of the partial download at path
+// along with the offset to resume the download from.
+// Returns zero offset if the download cannot be resumed
+func getPartialMetadata(path string) (metadata downloadMetadata, offset int64) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return metadata, 0
+	}
+	metadata, err = getMetadata(path)
+	if err != nil || metadata.validator() == "" {
+		return metadata, 0
+	}
+	return metadata, fi.Size()
+}
+
+func removePartial(path string) {
+	_ = os.Remove(path)
+	_ = os.Remove(metadataPath(path))
+}
+
+// parseContentRange parses the value of the Content-Range header
+// in the `bytes <start>-<end>/<size>` format.
+// Returns the start offset and the total size (or -1 if unknown)
+func parseContentRange(s string) (start, size int64) {
+	var end int64
+	if _, err := fmt.Sscanf(s, "bytes %d-%d/%d", &start, &end, &size); err == nil {
+		return start, size
+	}
+	if _, err := fmt.Sscanf(s, "bytes %d-%d/*", &start, &end); err == nil {
+		return start, -1
+	}
+	return -1, -1
+}
+
+// hashFile writes the first n bytes of the file at path to w
+func hashFile(w io.Writer, path string, n int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	defer f.Close()
+	_, err = io.CopyN(w, f, n)
+	return trace.Wrap(err)
+}
@@ -0,0 +1,541 @@
+package magnet
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// ArchiveTar describes an uncompressed tar archive
+	ArchiveTar = "tar"
+	// ArchiveTarGzip describes a gzip-compressed tar archive
+	ArchiveTarGzip = "tar.gz"
+	// ArchiveTarXz describes an xz-compressed tar archive.
+	// Requires the xz command
+	ArchiveTarXz = "tar.xz"
+	// ArchiveTarZstd describes a zstd-compressed tar archive.
+	// Requires the zstd command
+	ArchiveTarZstd = "tar.zst"
+	// ArchiveZip describes a zip archive
+	ArchiveZip = "zip"
+	// ArchiveGzip describes a single gzip-compressed file
+	ArchiveGzip = "gz"
+	// ArchiveXz describes a single xz-compressed file.
+	// Requires the xz command
+	ArchiveXz = "xz"
+)
+
+// archiveSuffixes maps file name suffixes to archive formats.
+// Longer suffixes come first
+var archiveSuffixes = []struct {
+	suffix string
+	format string
+}{
+	{".tar.gz", ArchiveTarGzip},
+	{".tar.xz", ArchiveTarXz},
+	{".tar.zst", ArchiveTarZstd},
+	{".tgz", ArchiveTarGzip},
+	{".txz", ArchiveTarXz},
+	{".tzst", ArchiveTarZstd},
+	{".tar", ArchiveTar},
+	{".zip", ArchiveZip},
+	{".gz", ArchiveGzip},
+	{".xz", ArchiveXz},
+}
+
+// SetStripComponents sets the number of leading path components to strip from archive entries.
+func (c *DownloadConfig) SetStripComponents(n int) *DownloadConfig {
+	c.StripComponents = n
+	return c
+}
+
+// AddInclude adds patterns of archive entries to extract.
+// Patterns are matched against the entry path after stripping leading components
+// using path.Match syntax. A pattern matching a directory includes its contents.
+// All entries are extracted if no patterns have been specified.
+func (c *DownloadConfig) AddInclude(patterns ...string) *DownloadConfig {
+	c.Include = append(c.Include, patterns...)
+	return c
+}
+
+// SetArchiveFormat sets the format of the archive (e.g. ArchiveTarGzip).
+// By default, the format is detected from the URL.
+func (c *DownloadConfig) SetArchiveFormat(format string) *DownloadConfig {
+	c.ArchiveFormat = format
+	return c
+}
+
+// DownloadAndExtract downloads the archive at url and extracts it into a directory in the cache.
+// See DownloadConfig.DownloadAndExtract for details
+func (m *MagnetTarget) DownloadAndExtract(ctx context.Context, url string) (dir string, err error) {
+	return m.Downloader().DownloadAndExtract(ctx, url)
+}
+
+// DownloadAndExtract downloads the archive at url and extracts it into a directory in the cache.
+// Returns the path to the directory with the extracted contents.
+//
+// The directory is keyed by the digest of the archive and the extraction options,
+// so an already extracted tree is reused as long as the archive hasn't changed.
+// Single-file archives (.gz and .xz) are extracted into a file named after the URL without the extension.
+//
+// Entries with paths (or link targets) pointing outside of the destination directory are rejected.
+func (c *DownloadConfig) DownloadAndExtract(ctx context.Context, url string) (dir string, err error) {
+	format := c.ArchiveFormat
+	if format == "" {
+		format, err = detectArchiveFormat(url)
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+	}
+
+	archive, err := c.Download(ctx, url)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	metadata, err := getMetadata(archive)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	key := digest.FromString(fmt.Sprintf("%v %v %v %v", metadata.SHA2Sum, format, c.StripComponents, c.Include))
+	dir = filepath.Join(c.target.root.cacheDir(), "extract", key.Encoded())
+
+	unlock, err := lockFile(ctx, fmt.Sprintf("%v.lock", dir))
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	defer unlock()
+
+	if _, err := os.Stat(dir); err == nil {
+		touchCache(dir)
+		return dir, nil
+	}
+
+	// extract into a temporary directory so an interrupted extraction is never reused
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), filepath.Base(dir)+cacheTempMarker)
+	if err != nil {
+		return "", trace.ConvertSystemError(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	name, err := urlFileName(url)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	if err := c.extract(ctx, archive, tmp, format, name); err != nil {
+		return "", trace.Wrap(err).AddField("url", url)
+	}
+
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return "", trace.ConvertSystemError(err)
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return "", trace.ConvertSystemError(err)
+	}
+
+	c.target.Printlnf("Extracted %v to %v.", url, dir)
+	return dir, nil
+}
+
+func (c *DownloadConfig) extract(ctx context.Context, archive, dir, format, name string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	defer f.Close()
+
+	switch format {
+	case ArchiveZip:
+		fi, err := f.Stat()
+		if err != nil {
+			return trace.ConvertSystemError(err)
+		}
+		return trace.Wrap(c.extractZip(f, fi.Size(), dir))
+	case ArchiveGzip, ArchiveXz:
+		r, err := decompress(ctx, f, format)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		defer r.Close()
+		name = strings.TrimSuffix(name, "."+format)
+		if !isValidFileName(name) {
+			return trace.BadParameter("invalid file name %q", name)
+		}
+		return trace.Wrap(writeExtractedFile(filepath.Join(dir, name), r, 0644))
+	case ArchiveTar, ArchiveTarGzip, ArchiveTarXz, ArchiveTarZstd:
+		r, err := decompress(ctx, f, strings.TrimPrefix(strings.TrimPrefix(format, ArchiveTar), "."))
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		defer r.Close()
+		return trace.Wrap(c.extractTar(r, dir))
+	}
+	return trace.BadParameter("unsupported archive format %q", format)
+}
+
+func (c *DownloadConfig) extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	var links []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return trace.Wrap(checkSymlinks(dir, links))
+		}
+		if err != nil {
+			return trace.Wrap(err)
+		}
+
+		name, ok, err := c.entryName(hdr.Name)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if !ok {
+			continue
+		}
+		target, err := securePath(dir, name)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		// '\x00' marks regular files in pre-POSIX archives (formerly tar.TypeRegA)
+		case tar.TypeReg, '\x00':
+			err = writeExtractedFile(target, tr, hdr.FileInfo().Mode().Perm())
+		case tar.TypeSymlink:
+			err = writeSymlink(dir, target, hdr.Linkname)
+			links = append(links, target)
+		case tar.TypeLink:
+			linkName, ok, _ := c.entryName(hdr.Linkname)
+			if !ok {
+				return trace.BadParameter("hard link %v points to %v which is not extracted", hdr.Name, hdr.Linkname)
+			}
+			var source string
+			source, err = securePath(dir, linkName)
+			if err == nil {
+				err = os.MkdirAll(filepath.Dir(target), 0755)
+			}
+			if err == nil {
+				err = os.Link(source, target)
+			}
+		default:
+			// ignore devices, fifos and other special files
+		}
+		if err != nil {
+			return trace.Wrap(err).AddField("entry", hdr.Name)
+		}
+	}
+}
+
+func (c *DownloadConfig) extractZip(r io.ReaderAt, size int64, dir string) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	var links []string
+	for _, f := range zr.File {
+		name, ok, err := c.entryName(f.Name)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if !ok {
+			continue
+		}
+		target, err := securePath(dir, name)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if err := extractZipEntry(f, dir, target); err != nil {
+			return trace.Wrap(err).AddField("entry", f.Name)
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			links = append(links, target)
+		}
+	}
+	return trace.Wrap(checkSymlinks(dir, links))
+}
+
+func extractZipEntry(f *zip.File, dir, target string) error {
+	mode := f.Mode()
+	if mode.IsDir() {
+		return trace.ConvertSystemError(os.MkdirAll(target, 0755))
+	}
+	r, err := f.Open()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer r.Close()
+	if mode&os.ModeSymlink != 0 {
+		linkname, err := ioutil.ReadAll(r)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		return trace.Wrap(writeSymlink(dir, target, string(linkname)))
+	}
+	perm := mode.Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+	return trace.Wrap(writeExtractedFile(target, r, perm))
+}
+
+// entryName returns the path of the archive entry name after stripping leading components.
+// Returns false if the entry should be skipped
+func (c *DownloadConfig) entryName(name string) (string, bool, error) {
+	name = path.Clean(strings.TrimLeft(filepath.ToSlash(name), "/"))
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", false, trace.BadParameter("archive entry %q points outside of the destination directory", name)
+	}
+	parts := strings.Split(name, "/")
+	if name == "." || len(parts) <= c.StripComponents {
+		return "", false, nil
+	}
+	name = path.Join(parts[c.StripComponents:]...)
+	if len(c.Include) == 0 {
+		return name, true, nil
+	}
+	for _, pattern := range c.Include {
+		// match the entry itself or any of its parent directories
+		for p := name; p != "."; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return name, true, nil
+			}
+		}
+	}
+	return "", false, nil
+}
+
+// securePath returns the path for name inside dir.
+// Returns an error if the resulting path is outside of dir
+// or any of its parent directories is a symlink extracted earlier
+func securePath(dir, name string) (string, error) {
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if !isWithin(dir, target) {
+		return "", trace.BadParameter("archive entry %q points outside of the destination directory", name)
+	}
+	for p := filepath.Dir(target); p != dir && isWithin(dir, p); p = filepath.Dir(p) {
+		if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", trace.BadParameter("archive entry %q is extracted through a symlink", name)
+		}
+	}
+	return target, nil
+}
+
+// writeSymlink creates the symlink at target pointing to linkname.
+// Returns an error if the link points outside of dir once resolved
+// against the symlinks already extracted
+func writeSymlink(dir, target, linkname string) error {
+	if !isWithinResolved(dir, filepath.Dir(target), linkname) {
+		return trace.BadParameter("symlink %v points outside of the destination directory: %v", target, linkname)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	if err := removeSymlink(target); err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.ConvertSystemError(os.Symlink(linkname, target))
+}
+
+// checkSymlinks verifies that none of the extracted symlinks points outside of dir.
+// The check is repeated after extraction since a link extracted later can change
+// how the target of an earlier link resolves
+func checkSymlinks(dir string, links []string) error {
+	for _, link := range links {
+		linkname, err := os.Readlink(link)
+		if err != nil {
+			return trace.ConvertSystemError(err)
+		}
+		if !isWithinResolved(dir, filepath.Dir(link), linkname) {
+			return trace.BadParameter("symlink %v points outside of the destination directory: %v", link, linkname)
+		}
+	}
+	return nil
+}
+
+// isWithinResolved returns true if linkname relative to the directory parent
+// stays within dir while following the symlinks inside dir component by component
+func isWithinResolved(dir, parent, linkname string) bool {
+	if filepath.IsAbs(linkname) || !isWithin(dir, parent) {
+		return false
+	}
+	rel, err := filepath.Rel(dir, parent)
+	if err != nil {
+		return false
+	}
+	resolved := dir
+	parts := append(strings.Split(filepath.ToSlash(rel), "/"), strings.Split(filepath.ToSlash(linkname), "/")...)
+	for links := 0; len(parts) != 0; {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if resolved == dir {
+				return false
+			}
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		fi, err := os.Lstat(next)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		// bail out on symlink loops
+		if links++; links > 255 {
+			return false
+		}
+		target, err := os.Readlink(next)
+		if err != nil || filepath.IsAbs(target) {
+			return false
+		}
+		parts = append(strings.Split(filepath.ToSlash(target), "/"), parts...)
+	}
+	return true
+}
+
+// removeSymlink removes the symlink at path so it is replaced instead of written through.
+// Does nothing if path does not exist or is not a symlink
+func removeSymlink(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	return trace.ConvertSystemError(os.Remove(path))
+}
+
+func writeExtractedFile(target string, r io.Reader, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	// never write through a symlink extracted earlier
+	if err := removeSymlink(target); err != nil {
+		return trace.Wrap(err)
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return trace.Wrap(err)
+	}
+	return trace.ConvertSystemError(f.Close())
+}
+
+func isWithin(dir, target string) bool {
+	rel, err := filepath.Rel(dir, target)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// decompress returns the reader that decompresses r with the given compression.
+// xz and zstd are decompressed with the external commands
+func decompress(ctx context.Context, r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "":
+		return ioutil.NopCloser(r), nil
+	case "gz":
+		gr, err := gzip.NewReader(r)
+		return gr, trace.Wrap(err)
+	case "xz", "zst":
+		name := map[string]string{"xz": "xz", "zst": "zstd"}[compression]
+		bin, err := exec.LookPath(name)
+		if err != nil {
+			return nil, trace.NotFound("the %v command is required to decompress %v archives but was not found in PATH", name, compression)
+		}
+		cmd := exec.CommandContext(ctx, bin, "-d", "-c")
+		cmd.Stdin = r
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, trace.Wrap(err, "%v is required to decompress %v archives", name, compression)
+		}
+		return &cmdReader{ReadCloser: out, cmd: cmd}, nil
+	}
+	return nil, trace.BadParameter("unsupported compression %q", compression)
+}
+
+// cmdReader reads the output of a command and waits for the command on Close
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *cmdReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		// surface decompression errors
+		if werr := r.cmd.Wait(); werr != nil {
+			return n, trace.Wrap(werr)
+		}
+		r.cmd = nil
+	}
+	return n, err
+}
+
+func (r *cmdReader) Close() error {
+	if r.cmd == nil {
+		return nil
+	}
+	r.ReadCloser.Close()
+	if r.cmd.Process != nil {
+		_ = r.cmd.Process.Kill()
+	}
+	_ = r.cmd.Wait()
+	r.cmd = nil
+	return nil
+}
+
+func detectArchiveFormat(rawurl string) (string, error) {
+	name, err := urlFileName(rawurl)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	name = strings.ToLower(name)
+	for _, s := range archiveSuffixes {
+		if strings.HasSuffix(name, s.suffix) {
+			return s.format, nil
+		}
+	}
+	return "", trace.BadParameter("unable to detect archive format of %v, use SetArchiveFormat", rawurl)
+}
+
+// urlFileName returns the last element of the URL path.
+// Returns an error if the path does not end with a valid file name
+func urlFileName(rawurl string) (string, error) {
+	p := rawurl
+	if u, err := url.Parse(rawurl); err == nil {
+		p = u.Path
+	}
+	name := path.Base(p)
+	if !isValidFileName(name) {
+		return "", trace.BadParameter("unable to determine the file name from %v", rawurl)
+	}
+	return name, nil
+}
+
+// isValidFileName returns true if name can be used as the name of a file within a directory
+func isValidFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
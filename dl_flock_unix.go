@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package magnet
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/gravitational/trace"
+)
+
+// tryLockFile attempts to acquire the exclusive lock on f without blocking.
+// Returns false if the file is locked by another process
+func tryLockFile(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	if err != nil {
+		return false, trace.ConvertSystemError(err)
+	}
+	return true, nil
+}
+
+func unlockFile(f *os.File) error {
+	return trace.ConvertSystemError(syscall.Flock(int(f.Fd()), syscall.LOCK_UN))
+}
@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package magnet
+
+import "os"
+
+// tryLockFile is a no-op on windows: downloads are only serialized within the process
+func tryLockFile(f *os.File) (bool, error) {
+	return true, nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
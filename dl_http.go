@@ -0,0 +1,363 @@
+package magnet
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// HTTPConfig configures the HTTP client used for downloads
+type HTTPConfig struct {
+	// Header optionally specifies additional request headers.
+	// Headers are only sent to the host of the download URL, not to mirrors or rewritten hosts
+	Header http.Header
+	// BearerToken optionally specifies the token for the Authorization header,
+	// e.g. the value of a secret EnvVar. The token is redacted from the output.
+	// The token is only sent to the host of the download URL, not to mirrors or rewritten hosts
+	BearerToken string
+	// NetrcFile optionally specifies the path to the .netrc file with credentials
+	// used if no Authorization header has been configured.
+	// Defaults to $NETRC or ~/.netrc
+	NetrcFile string
+	// CABundle optionally specifies the path to the PEM-encoded bundle of certificate authorities
+	// trusted in addition to the system roots
+	CABundle string
+	// Proxy optionally specifies the URL of the proxy server.
+	// Defaults to the proxy configured with HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	Proxy string
+	// ConnectTimeout optionally limits the time to establish the connection
+	// including the TLS handshake
+	ConnectTimeout time.Duration
+	// IdleTimeout optionally limits the time to wait for response data,
+	// e.g. to abort stalled downloads
+	IdleTimeout time.Duration
+}
+
+// SetHeader sets the request header for the download.
+func (c *DownloadConfig) SetHeader(key, value string) *DownloadConfig {
+	if c.HTTP.Header == nil {
+		c.HTTP.Header = make(http.Header)
+	}
+	c.HTTP.Header.Set(key, value)
+	return c
+}
+
+// SetBearerToken sets the token for the Authorization header of the download.
+func (c *DownloadConfig) SetBearerToken(token string) *DownloadConfig {
+	c.HTTP.BearerToken = token
+	return c
+}
+
+// SetNetrcFile sets the path to the .netrc file with credentials for the download.
+func (c *DownloadConfig) SetNetrcFile(path string) *DownloadConfig {
+	c.HTTP.NetrcFile = path
+	return c
+}
+
+// SetCABundle sets the path to the bundle of additional trusted certificate authorities.
+func (c *DownloadConfig) SetCABundle(path string) *DownloadConfig {
+	c.HTTP.CABundle = path
+	return c
+}
+
+// SetProxy sets the URL of the proxy server for the download.
+func (c *DownloadConfig) SetProxy(proxy string) *DownloadConfig {
+	c.HTTP.Proxy = proxy
+	return c
+}
+
+// SetTimeouts sets the connect and idle timeouts for the download.
+func (c *DownloadConfig) SetTimeouts(connect, idle time.Duration) *DownloadConfig {
+	c.HTTP.ConnectTimeout = connect
+	c.HTTP.IdleTimeout = idle
+	return c
+}
+
+// merge returns the configuration with the unset fields set from defaults.
+// Headers are merged with the headers in r taking precedence
+func (r HTTPConfig) merge(defaults HTTPConfig) HTTPConfig {
+	header := make(http.Header)
+	for key, values := range defaults.Header {
+		header[key] = values
+	}
+	for key, values := range r.Header {
+		header[key] = values
+	}
+	r.Header = header
+	if r.BearerToken == "" {
+		r.BearerToken = defaults.BearerToken
+	}
+	if r.NetrcFile == "" {
+		r.NetrcFile = defaults.NetrcFile
+	}
+	if r.CABundle == "" {
+		r.CABundle = defaults.CABundle
+	}
+	if r.Proxy == "" {
+		r.Proxy = defaults.Proxy
+	}
+	if r.ConnectTimeout == 0 {
+		r.ConnectTimeout = defaults.ConnectTimeout
+	}
+	if r.IdleTimeout == 0 {
+		r.IdleTimeout = defaults.IdleTimeout
+	}
+	return r
+}
+
+// forURL returns the configuration for requesting target on behalf of the download of url.
+// Credentials and custom headers are removed if target is on a different host,
+// e.g. a mirror, so they are not leaked to third parties.
+// Netrc credentials are looked up per host and are kept
+func (r HTTPConfig) forURL(url, target string) HTTPConfig {
+	if sameHost(url, target) {
+		return r
+	}
+	r.Header = nil
+	r.BearerToken = ""
+	return r
+}
+
+// sameHost returns true if both URLs have the same scheme and host
+func sameHost(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return ua.Scheme == ub.Scheme && strings.EqualFold(ua.Host, ub.Host)
+}
+
+// httpClients caches HTTP clients by transport configuration
+// so connections are reused across downloads
+type httpClients struct {
+	mu      sync.Mutex
+	clients map[string]*http.Client
+}
+
+// client returns the HTTP client for the transport configuration in config
+func (r *httpClients) client(config HTTPConfig) (*http.Client, error) {
+	key := fmt.Sprintf("%v|%v|%v", config.CABundle, config.Proxy, config.ConnectTimeout)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client, ok := r.clients[key]; ok {
+		return client, nil
+	}
+	client, err := newHTTPClient(config)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if r.clients == nil {
+		r.clients = make(map[string]*http.Client)
+	}
+	r.clients[key] = client
+	return client, nil
+}
+
+func newHTTPClient(config HTTPConfig) (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   config.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   config.ConnectTimeout,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if config.Proxy != "" {
+		proxy, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, trace.BadParameter("invalid proxy URL %q: %v", config.Proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if config.CABundle != "" {
+		pool, err := loadCABundle(config.CABundle)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, trace.BadParameter("no certificates found in CA bundle %v", path)
+	}
+	return pool, nil
+}
+
+// httpGetRequest sends the GET request for url configured with config.
+// The response body is closed if no data has been received within config.IdleTimeout
+func httpGetRequest(ctx context.Context, client *http.Client, url string, header http.Header, config HTTPConfig) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		cancel()
+		return nil, trace.Wrap(err)
+	}
+	req = req.WithContext(ctx)
+
+	for key, values := range config.Header {
+		req.Header[key] = values
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if req.Header.Get("Authorization") == "" {
+		switch {
+		case config.BearerToken != "":
+			RegisterSecret(config.BearerToken)
+			req.Header.Set("Authorization", "Bearer "+config.BearerToken)
+		default:
+			if login, password, ok := netrcCredentials(config.NetrcFile, req.URL.Hostname()); ok {
+				RegisterSecret(password)
+				req.SetBasicAuth(login, password)
+			}
+		}
+	}
+
+	var timer *time.Timer
+	if config.IdleTimeout > 0 {
+		timer = time.AfterFunc(config.IdleTimeout, cancel)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		if timer != nil && !timer.Stop() {
+			return nil, trace.ConnectionProblem(err, "no response from %v within %v", req.URL.Host, config.IdleTimeout)
+		}
+		return nil, trace.Wrap(err)
+	}
+
+	resp.Body = &idleTimeoutReader{
+		ReadCloser: resp.Body,
+		timer:      timer,
+		timeout:    config.IdleTimeout,
+		cancel:     cancel,
+	}
+	return resp, nil
+}
+
+// idleTimeoutReader aborts the response if no data has been read within the timeout
+type idleTimeoutReader struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+	cancel  context.CancelFunc
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.timer != nil {
+		if !r.timer.Stop() {
+			return n, trace.ConnectionProblem(err, "download stalled for %v", r.timeout)
+		}
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+func (r *idleTimeoutReader) Close() error {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.cancel()
+	return r.ReadCloser.Close()
+}
+
+// netrcCredentials returns the credentials for host from the .netrc file at path.
+// Defaults to $NETRC or ~/.netrc if path is empty
+func netrcCredentials(path, host string) (login, password string, ok bool) {
+	if path == "" {
+		path = os.Getenv("NETRC")
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", false
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", false
+	}
+	defer f.Close()
+	return parseNetrc(f, host)
+}
+
+// parseNetrc returns the credentials for the machine entry matching host.
+// The default entry is ignored
+func parseNetrc(r io.Reader, host string) (login, password string, ok bool) {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanWords)
+	var machine string
+	var inMacro bool
+	for scanner.Scan() {
+		token := scanner.Text()
+		if inMacro {
+			// macro definitions extend to the next empty line which is not preserved by ScanWords,
+			// so skip until the next entry
+			if token != "machine" && token != "default" {
+				continue
+			}
+			inMacro = false
+		}
+		switch token {
+		case "machine", "default":
+			if machine == host && login != "" {
+				return login, password, true
+			}
+			machine, login, password = "", "", ""
+			if token == "machine" && scanner.Scan() {
+				machine = scanner.Text()
+			}
+		case "login":
+			if scanner.Scan() {
+				login = scanner.Text()
+			}
+		case "password":
+			if scanner.Scan() {
+				password = scanner.Text()
+			}
+		case "macdef":
+			inMacro = true
+		}
+	}
+	if machine == host && login != "" {
+		return login, password, true
+	}
+	return "", "", false
+}
@@ -0,0 +1,176 @@
+package magnet
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/gravitational/trace"
+	"github.com/opencontainers/go-digest"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// downloadLock maintains the lock file with the digests of downloaded files.
+// Digests are recorded on the first download of a URL and verified on
+// every subsequent download
+type downloadLock struct {
+	path string
+	// refresh specifies whether the recorded digests are replaced instead of verified
+	refresh bool
+
+	mu      sync.Mutex
+	entries map[string]digest.Digest
+}
+
+// downloadLockFile defines the format of the download lock file
+type downloadLockFile struct {
+	// Downloads maps URLs to the digests of the files
+	Downloads map[string]digest.Digest `yaml:"downloads"`
+}
+
+// RefreshDownloadLock downloads all files recorded in the download lock file
+// and records the new digests.
+// See Magnet.RefreshDownloadLock for details
+func RefreshDownloadLock(ctx context.Context) error {
+	if root == nil {
+		return trace.NotFound("magnet is not initialized")
+	}
+	return root.RefreshDownloadLock(ctx)
+}
+
+// RefreshDownloadLock downloads all files recorded in the download lock file
+// and records the new digests.
+// Use this to deliberately accept changes in upstream artifacts
+func (m *Magnet) RefreshDownloadLock(ctx context.Context) (err error) {
+	lock, err := m.downloadLock()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if lock == nil {
+		return trace.BadParameter("download lock file is not configured")
+	}
+
+	t := m.Target("refresh download lock")
+	defer func() { t.Complete(err) }()
+
+	var errors []error
+	for _, url := range lock.urls() {
+		c := t.Downloader()
+		c.refreshLock = true
+		if _, err := c.Download(ctx, url); err != nil {
+			errors = append(errors, trace.Wrap(err, "failed to refresh %v", url))
+		}
+	}
+	return trace.NewAggregate(errors...)
+}
+
+// downloadLock returns the download lock if the lock file has been configured.
+// Returns nil otherwise
+func (m *Magnet) downloadLock() (*downloadLock, error) {
+	if m.DownloadLockFile == "" {
+		return nil, nil
+	}
+	m.dlLockOnce.Do(func() {
+		m.dlLock, m.dlLockErr = loadDownloadLock(m.DownloadLockFile)
+		if m.dlLock != nil {
+			m.dlLock.refresh = downloadLockRefresh
+		}
+	})
+	return m.dlLock, trace.Wrap(m.dlLockErr)
+}
+
+func loadDownloadLock(path string) (*downloadLock, error) {
+	entries, err := readDownloadLock(path)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &downloadLock{
+		path:    path,
+		entries: entries,
+	}, nil
+}
+
+// readDownloadLock reads the entries of the lock file at path.
+// Returns no entries if the file does not exist
+func readDownloadLock(path string) (map[string]digest.Digest, error) {
+	entries := make(map[string]digest.Digest)
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, trace.ConvertSystemError(err)
+	}
+	var file downloadLockFile
+	if err := yaml.Unmarshal(buf, &file); err != nil {
+		return nil, trace.Wrap(err, "invalid download lock file %v", path)
+	}
+	for url, d := range file.Downloads {
+		if _, err := parseDigest(string(d)); err != nil {
+			return nil, trace.Wrap(err, "invalid download lock file %v", path)
+		}
+		entries[url] = d
+	}
+	return entries, nil
+}
+
+// get returns the recorded digest for url.
+// Returns an empty digest if there's no record or the lock is being refreshed
+func (r *downloadLock) get(url string) digest.Digest {
+	if r.refresh {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.entries[url]
+}
+
+// record records the digest for url and updates the lock file.
+// The lock file is re-read under a file lock and merged with the new digest,
+// so concurrent processes sharing the lock file do not overwrite each other's entries.
+// Returns the previously recorded digest
+func (r *downloadLock) record(ctx context.Context, url string, d digest.Digest) (previous digest.Digest, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	unlock, err := lockFile(ctx, r.path+".lock")
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	defer unlock()
+
+	entries, err := readDownloadLock(r.path)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	r.entries = entries
+	previous = entries[url]
+	if previous == d {
+		return previous, nil
+	}
+	r.entries[url] = d
+	return previous, trace.Wrap(r.write())
+}
+
+// write writes the lock file atomically
+func (r *downloadLock) write() error {
+	buf, err := yaml.Marshal(downloadLockFile{Downloads: r.entries})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	buf = append([]byte("# Code generated by magnet. Digests of downloaded files, refresh with DOWNLOAD_LOCK_REFRESH=true.\n"), buf...)
+
+	return trace.Wrap(writeFileAtomic(r.path, buf, 0644))
+}
+
+func (r *downloadLock) urls() (urls []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for url := range r.entries {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	return urls
+}
@@ -0,0 +1,152 @@
+package magnet
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// DefaultDownloadConcurrency specifies the default number of concurrent downloads
+const DefaultDownloadConcurrency = 4
+
+// downloadManager limits the number of concurrent downloads and
+// deduplicates concurrent downloads of the same file within the process
+type downloadManager struct {
+	// sem limits the number of concurrently running downloads
+	sem chan struct{}
+
+	mu       sync.Mutex
+	inflight map[string]*downloadCall
+}
+
+// downloadCall describes a download in progress
+type downloadCall struct {
+	// done is closed when the download has completed
+	done chan struct{}
+	path string
+	err  error
+}
+
+func newDownloadManager(concurrency int) *downloadManager {
+	if concurrency <= 0 {
+		concurrency = DefaultDownloadConcurrency
+	}
+	return &downloadManager{
+		sem:      make(chan struct{}, concurrency),
+		inflight: make(map[string]*downloadCall),
+	}
+}
+
+// downloads returns the download manager for this magnet instance
+func (m *Magnet) downloads() *downloadManager {
+	m.dlManagerOnce.Do(func() {
+		m.dlManager = newDownloadManager(m.DownloadConcurrency)
+	})
+	return m.dlManager
+}
+
+// do runs the download fn identified with key.
+// If a download with the same key is already in progress, do waits for it to complete
+// and returns its result instead.
+// The download is run while holding the file lock at lockPath to prevent
+// concurrent downloads of the same file by other processes
+func (r *downloadManager) do(ctx context.Context, key, lockPath string, fn func() (string, error)) (path string, err error) {
+	r.mu.Lock()
+	call, ok := r.inflight[key]
+	if !ok {
+		call = &downloadCall{done: make(chan struct{})}
+		r.inflight[key] = call
+	}
+	r.mu.Unlock()
+
+	if ok {
+		select {
+		case <-call.done:
+			return call.path, trace.Wrap(call.err)
+		case <-ctx.Done():
+			return "", trace.Wrap(ctx.Err())
+		}
+	}
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.inflight, key)
+		r.mu.Unlock()
+		call.path, call.err = path, err
+		close(call.done)
+	}()
+
+	unlock, err := lockFile(ctx, lockPath)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	defer unlock()
+
+	select {
+	case r.sem <- struct{}{}:
+	case <-ctx.Done():
+		return "", trace.Wrap(ctx.Err())
+	}
+	defer func() { <-r.sem }()
+
+	return fn()
+}
+
+// lockFile acquires the exclusive lock on the file at path, creating it if necessary.
+// Blocks until the lock is acquired or the context is canceled.
+// Returns the function to release the lock
+func lockFile(ctx context.Context, path string) (unlock func(), err error) {
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	for {
+		ok, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, trace.Wrap(err).AddField("path", path)
+		}
+		if ok {
+			return func() {
+				_ = unlockFile(f)
+				f.Close()
+			}, nil
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			f.Close()
+			return nil, trace.Wrap(ctx.Err())
+		}
+	}
+}
+
+// writeFileAtomic writes data to the file at path via a temporary file
+// so readers never observe a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return trace.ConvertSystemError(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	return trace.ConvertSystemError(os.Rename(tmp.Name(), path))
+}
@@ -0,0 +1,103 @@
+package magnet
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gravitational/trace"
+)
+
+// URLRewrite defines a rule to replace the prefix of a download URL
+type URLRewrite struct {
+	// Prefix specifies the URL prefix to replace.
+	// An empty prefix matches all URLs
+	Prefix string
+	// Replacement specifies the replacement for the prefix
+	Replacement string
+}
+
+// Apply returns the url with the prefix replaced.
+// Returns false if the url does not match the rule
+func (r URLRewrite) Apply(url string) (string, bool) {
+	if !strings.HasPrefix(url, r.Prefix) {
+		return url, false
+	}
+	return r.Replacement + strings.TrimPrefix(url, r.Prefix), true
+}
+
+// URLRewriteSeparator separates the prefix from the replacement in a rewrite rule.
+// Neither '>' nor whitespace can appear in a valid URL unescaped, so the rules
+// can contain arbitrary URLs including query strings
+const URLRewriteSeparator = "=>"
+
+// ParseURLRewrite parses the rule in the <prefix>=><replacement> format
+func ParseURLRewrite(s string) (URLRewrite, error) {
+	parts := strings.SplitN(s, URLRewriteSeparator, 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return URLRewrite{}, trace.BadParameter("invalid URL rewrite rule %q, expected <prefix>%v<replacement>",
+			s, URLRewriteSeparator)
+	}
+	return URLRewrite{Prefix: parts[0], Replacement: parts[1]}, nil
+}
+
+// parseURLRewrites parses the whitespace-separated list of rewrite rules
+func parseURLRewrites(rules string) (result []URLRewrite, err error) {
+	for _, rule := range strings.Fields(rules) {
+		r, err := ParseURLRewrite(rule)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// downloadURLs returns the list of URLs to try for downloading url in order.
+// The first matching rewrite rule is applied to the URL and the matching mirrors
+// are appended as fallbacks
+func (m *Magnet) downloadURLs(url string) []string {
+	upstream := url
+	for _, r := range m.DownloadRewrites {
+		if rewritten, ok := r.Apply(url); ok {
+			upstream = rewritten
+			break
+		}
+	}
+	urls := []string{upstream}
+	for _, r := range m.DownloadMirrors {
+		if mirror, ok := r.Apply(url); ok && mirror != upstream {
+			urls = append(urls, mirror)
+		}
+	}
+	return urls
+}
+
+// get requests url trying the mirrors in order if upstream is unavailable.
+// Returns the response from the first server that has not failed
+func (c *DownloadConfig) get(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	config := c.HTTP.merge(c.target.root.DownloadHTTP)
+	client, err := c.target.root.httpClients.client(config)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var errors []error
+	for _, u := range c.target.root.downloadURLs(url) {
+		resp, err := httpGetRequest(ctx, client, u, header, config.forURL(url, u))
+		if err == nil && resp.StatusCode != http.StatusNotFound && resp.StatusCode < http.StatusInternalServerError {
+			if u != url {
+				c.target.Printlnf("Downloading %v from %v.", url, u)
+			}
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = trace.BadParameter("Unexpected status code: %v", resp.StatusCode)
+		}
+		if ctx.Err() != nil {
+			return nil, trace.Wrap(ctx.Err())
+		}
+		errors = append(errors, trace.Wrap(err).AddField("url", u))
+	}
+	return nil, trace.NewAggregate(errors...)
+}
@@ -0,0 +1,319 @@
+package magnet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/blake2b"
+)
+
+// maxSignatureSize limits the size of a detached signature
+const maxSignatureSize = 64 * 1024
+
+// SetSignature configures the download to verify the detached signature at signatureURL
+// against the trusted public keys in keyFiles.
+// Supported are ed25519 signatures in the minisign (both legacy and prehashed) and signify formats
+// and OpenPGP signatures. OpenPGP signatures are verified with the gpg command.
+// The format is detected from the key files: armored OpenPGP keys are used with gpg,
+// other files are expected to be minisign or signify public keys.
+func (c *DownloadConfig) SetSignature(signatureURL string, keyFiles ...string) *DownloadConfig {
+	c.SignatureURL = signatureURL
+	c.SignatureKeys = keyFiles
+	return c
+}
+
+// verifySignature verifies the detached signature of the downloaded file at path if configured.
+// The ID of the key that has produced the signature is recorded in the download metadata,
+// so the signature of an unchanged file is only verified once as long as the key is trusted.
+// In offline mode, the signature is never fetched.
+// Removes the file on failure
+func (c *DownloadConfig) verifySignature(ctx context.Context, url, path string) error {
+	if c.SignatureURL == "" {
+		return nil
+	}
+	if len(c.SignatureKeys) == 0 {
+		return trace.BadParameter("no trusted keys configured to verify the signature of %v", url)
+	}
+
+	metadata, err := getMetadata(path)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	keys, err := loadSignatureKeys(c.SignatureKeys)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if metadata.SignatureKeyID != "" {
+		trusted, err := keys.trusts(ctx, metadata.SignatureKeyID)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if trusted {
+			return nil
+		}
+	}
+	if c.target.root.DownloadOffline {
+		return trace.NotFound("signature of %v has not been verified and downloads are disabled in offline mode", url)
+	}
+
+	signature, err := c.fetchSignature(ctx)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	keyID, err := keys.verify(ctx, path, signature)
+	if err != nil {
+		_ = os.Remove(path)
+		_ = os.Remove(metadataPath(path))
+		return trace.Wrap(err, "failed to verify signature of %v", url)
+	}
+
+	c.target.Printlnf("Verified signature of %v with key %v.", url, keyID)
+	metadata.SignatureKeyID = keyID
+	return trace.Wrap(writeMetadata(metadata, path))
+}
+
+func (c *DownloadConfig) fetchSignature(ctx context.Context) ([]byte, error) {
+	resp, err := c.get(ctx, c.SignatureURL, nil)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, trace.BadParameter("Unexpected status code: %v", resp.StatusCode).AddField("url", c.SignatureURL)
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSignatureSize))
+	return buf, trace.Wrap(err)
+}
+
+// signatureKeys is the set of trusted public keys
+type signatureKeys struct {
+	// ed25519 maps minisign/signify key IDs to public keys
+	ed25519 map[string]ed25519.PublicKey
+	// pgp lists files with armored OpenPGP public keys
+	pgp []string
+	// pgpFingerprints lists the fingerprints of the OpenPGP keys and subkeys.
+	// Only loaded if needed
+	pgpFingerprints map[string]bool
+}
+
+func loadSignatureKeys(paths []string) (*signatureKeys, error) {
+	keys := &signatureKeys{
+		ed25519: make(map[string]ed25519.PublicKey),
+	}
+	for _, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, trace.ConvertSystemError(err)
+		}
+		if bytes.Contains(buf, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+			keys.pgp = append(keys.pgp, path)
+			continue
+		}
+		keyID, key, err := parseEd25519Key(buf)
+		if err != nil {
+			return nil, trace.Wrap(err, "invalid public key %v", path)
+		}
+		keys.ed25519[keyID] = key
+	}
+	return keys, nil
+}
+
+// trusts returns true if the key with the given ID is one of the trusted keys.
+// OpenPGP keys are identified by fingerprints listed with gpg
+func (r *signatureKeys) trusts(ctx context.Context, keyID string) (bool, error) {
+	if !strings.HasPrefix(keyID, "pgp:") {
+		_, ok := r.ed25519[keyID]
+		return ok, nil
+	}
+	if len(r.pgp) == 0 {
+		return false, nil
+	}
+	if r.pgpFingerprints == nil {
+		fingerprints, err := listPGPFingerprints(ctx, r.pgp)
+		if err != nil {
+			return false, trace.Wrap(err)
+		}
+		r.pgpFingerprints = fingerprints
+	}
+	return r.pgpFingerprints[strings.TrimPrefix(keyID, "pgp:")], nil
+}
+
+// verify verifies the signature of the file at path and returns the ID of the signing key
+func (r *signatureKeys) verify(ctx context.Context, path string, signature []byte) (keyID string, err error) {
+	if bytes.Contains(signature, []byte("-----BEGIN PGP SIGNATURE-----")) || len(r.ed25519) == 0 {
+		return verifyPGPSignature(ctx, r.pgp, path, signature)
+	}
+	return r.verifyEd25519(path, signature)
+}
+
+// verifyEd25519 verifies the signature in the minisign or signify format.
+// The trusted comment of a minisign signature is verified as well
+func (r *signatureKeys) verifyEd25519(path string, signature []byte) (keyID string, err error) {
+	lines := signatureLines(signature)
+	if len(lines) < 2 {
+		return "", trace.BadParameter("invalid signature: expected untrusted comment and signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 74 {
+		return "", trace.BadParameter("invalid signature encoding")
+	}
+	algorithm := string(sig[:2])
+	if algorithm != "Ed" && algorithm != "ED" {
+		return "", trace.BadParameter("unsupported signature algorithm %q", algorithm)
+	}
+	keyID = formatKeyID(sig[2:10])
+	key, ok := r.ed25519[keyID]
+	if !ok {
+		return "", trace.AccessDenied("signature created with untrusted key %v", keyID)
+	}
+
+	message, err := signedMessage(path, algorithm)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	if !ed25519.Verify(key, message, sig[10:]) {
+		return "", trace.AccessDenied("invalid signature")
+	}
+
+	if len(lines) >= 4 && strings.HasPrefix(lines[2], "trusted comment: ") {
+		comment := strings.TrimPrefix(lines[2], "trusted comment: ")
+		global, err := base64.StdEncoding.DecodeString(lines[3])
+		message := append(append([]byte{}, sig[10:]...), comment...)
+		if err != nil || !ed25519.Verify(key, message, global) {
+			return "", trace.AccessDenied("invalid trusted comment signature")
+		}
+	}
+	return keyID, nil
+}
+
+// signedMessage returns the message signed with the specified algorithm for the file at path.
+// Legacy ("Ed") signatures sign the file contents, while prehashed ("ED") signatures
+// (the minisign default) sign the BLAKE2b-512 hash of the file, which is computed
+// without reading the whole file into memory
+func signedMessage(path, algorithm string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	defer f.Close()
+	if algorithm == "Ed" {
+		message, err := ioutil.ReadAll(f)
+		return message, trace.ConvertSystemError(err)
+	}
+	hash, err := blake2b.New512(nil)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	return hash.Sum(nil), nil
+}
+
+// verifyPGPSignature verifies the OpenPGP signature with gpg using a temporary keyring
+// with the keys from keyFiles. Returns the fingerprint of the signing key
+func verifyPGPSignature(ctx context.Context, keyFiles []string, path string, signature []byte) (keyID string, err error) {
+	if len(keyFiles) == 0 {
+		return "", trace.BadParameter("no trusted OpenPGP keys configured")
+	}
+	home, err := ioutil.TempDir("", "magnet-gpg")
+	if err != nil {
+		return "", trace.ConvertSystemError(err)
+	}
+	defer os.RemoveAll(home)
+
+	sigPath := filepath.Join(home, "signature.asc")
+	if err := ioutil.WriteFile(sigPath, signature, 0600); err != nil {
+		return "", trace.ConvertSystemError(err)
+	}
+
+	args := append([]string{"--homedir", home, "--batch", "--quiet", "--import"}, keyFiles...)
+	if out, err := exec.CommandContext(ctx, "gpg", args...).CombinedOutput(); err != nil {
+		return "", trace.Wrap(err, "failed to import OpenPGP keys: %s", out)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "gpg", "--homedir", home, "--batch", "--status-fd", "1", "--verify", sigPath, path)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err = cmd.Run()
+
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if err == nil && len(fields) >= 3 && fields[0] == "[GNUPG:]" && fields[1] == "VALIDSIG" {
+			return fmt.Sprintf("pgp:%v", fields[2]), nil
+		}
+	}
+	return "", trace.AccessDenied("invalid OpenPGP signature: %s", strings.TrimSpace(stderr.String()))
+}
+
+// listPGPFingerprints returns the fingerprints of the OpenPGP keys and subkeys in keyFiles
+func listPGPFingerprints(ctx context.Context, keyFiles []string) (map[string]bool, error) {
+	home, err := ioutil.TempDir("", "magnet-gpg")
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	defer os.RemoveAll(home)
+
+	var stderr bytes.Buffer
+	args := append([]string{"--homedir", home, "--batch", "--with-colons", "--show-keys"}, keyFiles...)
+	cmd := exec.CommandContext(ctx, "gpg", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to list OpenPGP keys: %s", strings.TrimSpace(stderr.String()))
+	}
+	fingerprints := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		// fingerprint records carry the fingerprint in the tenth field
+		fields := strings.Split(line, ":")
+		if len(fields) > 9 && fields[0] == "fpr" {
+			fingerprints[fields[9]] = true
+		}
+	}
+	return fingerprints, nil
+}
+
+// parseEd25519Key parses the public key in the minisign or signify format
+func parseEd25519Key(buf []byte) (keyID string, key ed25519.PublicKey, err error) {
+	lines := signatureLines(buf)
+	if len(lines) == 0 {
+		return "", nil, trace.BadParameter("empty key")
+	}
+	// the key is either on its own or follows the untrusted comment
+	encoded := lines[len(lines)-1]
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) != 42 || string(data[:2]) != "Ed" {
+		return "", nil, trace.BadParameter("expected an ed25519 public key in the minisign or signify format")
+	}
+	return formatKeyID(data[2:10]), ed25519.PublicKey(data[10:]), nil
+}
+
+// formatKeyID formats the key ID as displayed by minisign
+func formatKeyID(id []byte) string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id))
+}
+
+// signatureLines returns the non-empty lines of buf
+func signatureLines(buf []byte) (lines []string) {
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
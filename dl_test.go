@@ -0,0 +1,635 @@
+package magnet
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravitational/magnet/pkg/progressui"
+	"github.com/gravitational/trace"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestDownloadVerifiesDigest(t *testing.T) {
+	content := "hello world"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, content)
+	}))
+	defer srv.Close()
+
+	target, cleanup := newTestTarget(t, Config{})
+	defer cleanup()
+
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	path, err := target.Downloader().SetSHA256(sum).Download(context.TODO(), srv.URL)
+	require.NoError(t, err)
+	requireFileContent(t, path, content)
+
+	_, err = target.Downloader().SetSHA256(fmt.Sprintf("%x", sha256.Sum256([]byte("other")))).Download(context.TODO(), srv.URL+"/other")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "checksum mismatch")
+}
+
+func TestDownloadLockFile(t *testing.T) {
+	content := "v1"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, content)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "magnet-lock")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	lockPath := filepath.Join(dir, "magnet.lock")
+
+	target, cleanup := newTestTarget(t, Config{DownloadLockFile: lockPath})
+	defer cleanup()
+
+	_, err = target.Download(context.TODO(), srv.URL)
+	require.NoError(t, err)
+
+	lock, err := loadDownloadLock(lockPath)
+	require.NoError(t, err)
+	require.Equal(t, digest.FromString("v1"), lock.get(srv.URL))
+
+	// upstream changes, a fresh download fails until the lock is refreshed
+	content = "v2"
+	require.NoError(t, os.RemoveAll(filepath.Join(target.root.cacheDir(), "dl")))
+	_, err = target.Download(context.TODO(), srv.URL)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "checksum mismatch")
+
+	require.NoError(t, target.root.RefreshDownloadLock(context.TODO()))
+	lock, err = loadDownloadLock(lockPath)
+	require.NoError(t, err)
+	require.Equal(t, digest.FromString("v2"), lock.get(srv.URL))
+
+	// processes sharing the lock file keep each other's entries
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		other, err := loadDownloadLock(lockPath)
+		require.NoError(t, err)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := other.record(context.TODO(), fmt.Sprintf("https://example.com/%v", i), digest.FromString("file"))
+			require.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	lock, err = loadDownloadLock(lockPath)
+	require.NoError(t, err)
+	require.Equal(t, digest.FromString("v2"), lock.get(srv.URL))
+	for i := 0; i < 4; i++ {
+		require.Equal(t, digest.FromString("file"), lock.get(fmt.Sprintf("https://example.com/%v", i)))
+	}
+}
+
+func TestDownloadResumesPartial(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	modTime := time.Now().Add(-time.Hour)
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file", modTime, strings.NewReader(content))
+	}))
+	defer srv.Close()
+
+	target, cleanup := newTestTarget(t, Config{})
+	defer cleanup()
+
+	// simulate an interrupted download
+	path := filepath.Join(target.root.cacheDir(), "dl", digest.FromString(srv.URL).String())
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, ioutil.WriteFile(partialPath(path), []byte(content[:300]), 0644))
+	require.NoError(t, writeMetadata(downloadMetadata{ETag: `"v1"`}, partialPath(path)))
+
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	result, err := target.Downloader().SetSHA256(sum).Download(context.TODO(), srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, path, result)
+	requireFileContent(t, path, content)
+	require.Equal(t, []string{"bytes=300-"}, ranges)
+
+	_, err = os.Stat(partialPath(path))
+	require.True(t, os.IsNotExist(err))
+
+	// the partial download is restarted if upstream has changed
+	ranges = nil
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, ioutil.WriteFile(partialPath(path), []byte("stale"), 0644))
+	require.NoError(t, writeMetadata(downloadMetadata{ETag: `"v0"`}, partialPath(path)))
+
+	_, err = target.Downloader().SetSHA256(sum).Download(context.TODO(), srv.URL)
+	require.NoError(t, err)
+	requireFileContent(t, path, content)
+	require.Equal(t, []string{"bytes=5-"}, ranges)
+}
+
+func TestDownloadRestartsOnceIfRangeNotSatisfiable(t *testing.T) {
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	}))
+	defer srv.Close()
+
+	target, cleanup := newTestTarget(t, Config{})
+	defer cleanup()
+
+	path := filepath.Join(target.root.cacheDir(), "dl", digest.FromString(srv.URL).String())
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, ioutil.WriteFile(partialPath(path), []byte("partial"), 0644))
+	require.NoError(t, writeMetadata(downloadMetadata{ETag: `"v1"`}, partialPath(path)))
+
+	_, err := target.Downloader().Download(context.TODO(), srv.URL)
+	require.Error(t, err)
+	require.Equal(t, []string{"bytes=7-", ""}, ranges)
+}
+
+func TestDownloadFutureReturnsURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "content")
+	}))
+	defer srv.Close()
+
+	target, cleanup := newTestTarget(t, Config{})
+	defer cleanup()
+
+	url, path, err := target.DownloadFuture(context.TODO(), srv.URL+"/file")()
+	require.NoError(t, err)
+	require.Equal(t, srv.URL+"/file", url)
+	requireFileContent(t, path, "content")
+
+	url, _, err = target.DownloadFuture(context.TODO(), srv.URL+"/missing")()
+	require.Error(t, err)
+	require.Equal(t, srv.URL+"/missing", url)
+}
+
+func TestDownloadManagerLimitsConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var active, maxActive int
+	requests := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		requests[r.URL.Path]++
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, r.URL.Path)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	target, cleanup := newTestTarget(t, Config{DownloadConcurrency: 2})
+	defer cleanup()
+
+	var futures []DownloadFutureFunc
+	for i := 0; i < 6; i++ {
+		// every file is requested twice
+		url := fmt.Sprintf("%v/file%v", srv.URL, i%3)
+		futures = append(futures, target.DownloadFuture(context.TODO(), url))
+	}
+	for _, future := range futures {
+		url, path, err := future()
+		require.NoError(t, err)
+		requireFileContent(t, path, strings.TrimPrefix(url, srv.URL))
+	}
+
+	require.LessOrEqual(t, maxActive, 2)
+	require.Equal(t, map[string]int{"/file0": 1, "/file1": 1, "/file2": 1}, requests)
+}
+
+func TestDownloadAndExtract(t *testing.T) {
+	archives := map[string][]byte{
+		"/release.tar.gz": newTarGz(t, map[string]string{
+			"release/bin/tool":   "tool",
+			"release/README":     "readme",
+			"release/lib/lib.so": "lib",
+		}),
+		"/evil.tar.gz": newTarGz(t, map[string]string{
+			"../evil": "evil",
+		}),
+		"/..gz": newGz(t, "evil"),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archives[r.URL.Path])
+	}))
+	defer srv.Close()
+
+	target, cleanup := newTestTarget(t, Config{})
+	defer cleanup()
+
+	dir, err := target.Downloader().
+		SetStripComponents(1).
+		AddInclude("bin", "README").
+		DownloadAndExtract(context.TODO(), srv.URL+"/release.tar.gz")
+	require.NoError(t, err)
+	requireFileContent(t, filepath.Join(dir, "bin", "tool"), "tool")
+	requireFileContent(t, filepath.Join(dir, "README"), "readme")
+	_, err = os.Stat(filepath.Join(dir, "lib"))
+	require.True(t, os.IsNotExist(err))
+
+	// the extracted tree is reused
+	reused, err := target.Downloader().
+		SetStripComponents(1).
+		AddInclude("bin", "README").
+		DownloadAndExtract(context.TODO(), srv.URL+"/release.tar.gz")
+	require.NoError(t, err)
+	require.Equal(t, dir, reused)
+
+	_, err = target.DownloadAndExtract(context.TODO(), srv.URL+"/evil.tar.gz")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "outside of the destination directory")
+
+	for _, rawurl := range []string{"https://example.com/..", "https://example.com/", "https://example.com/dir/."} {
+		_, err = urlFileName(rawurl)
+		require.Error(t, err, rawurl)
+	}
+	_, err = target.Downloader().SetArchiveFormat(ArchiveGzip).DownloadAndExtract(context.TODO(), srv.URL+"/..gz")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid file name")
+
+	// missing decompression commands are reported explicitly
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", "")
+	_, err = decompress(context.TODO(), strings.NewReader(""), "zst")
+	require.True(t, trace.IsNotFound(err))
+	require.Contains(t, err.Error(), "zstd command is required")
+}
+
+func TestExtractRejectsSymlinkChains(t *testing.T) {
+	// x -> . makes z -> x/../pwned resolve outside of the destination directory
+	entries := []struct {
+		name, linkname, content string
+	}{
+		{name: "x", linkname: "."},
+		{name: "z", linkname: "x/../pwned"},
+		{name: "z", content: "pwned"},
+	}
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		if e.linkname != "" {
+			hdr = &tar.Header{Name: e.name, Mode: 0777, Linkname: e.linkname, Typeflag: tar.TypeSymlink}
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name}
+		hdr.SetMode(0644)
+		content := e.content
+		if e.linkname != "" {
+			hdr.SetMode(os.ModeSymlink | 0777)
+			content = e.linkname
+		}
+		w, err := zw.CreateHeader(hdr)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	for _, format := range []string{ArchiveTar, ArchiveZip} {
+		parent, err := ioutil.TempDir("", "magnet-extract")
+		require.NoError(t, err)
+		defer os.RemoveAll(parent)
+		dir := filepath.Join(parent, "dir")
+		require.NoError(t, os.Mkdir(dir, 0755))
+
+		c := &DownloadConfig{}
+		if format == ArchiveTar {
+			err = c.extractTar(bytes.NewReader(tarBuf.Bytes()), dir)
+		} else {
+			err = c.extractZip(bytes.NewReader(zipBuf.Bytes()), int64(zipBuf.Len()), dir)
+		}
+		require.Error(t, err, format)
+		require.Contains(t, err.Error(), "outside of the destination directory", format)
+		_, err = os.Lstat(filepath.Join(parent, "pwned"))
+		require.True(t, os.IsNotExist(err), format)
+	}
+}
+
+func TestParseURLRewrites(t *testing.T) {
+	rewrites, err := parseURLRewrites("https://example.com/get?file=a,b=>https://mirror/a,b\n  https://other.com/=>https://mirror/other/?token=x ")
+	require.NoError(t, err)
+	require.Equal(t, []URLRewrite{
+		{Prefix: "https://example.com/get?file=a,b", Replacement: "https://mirror/a,b"},
+		{Prefix: "https://other.com/", Replacement: "https://mirror/other/?token=x"},
+	}, rewrites)
+
+	_, err = parseURLRewrites("https://example.com/=https://mirror/")
+	require.Error(t, err)
+}
+
+func TestDownloadMirrorsAndOffline(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+	var paths, auth []string
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		auth = append(auth, r.Header.Get("Authorization")+r.Header.Get("X-Api-Key"))
+		fmt.Fprint(w, "mirrored")
+	}))
+	defer mirror.Close()
+
+	target, cleanup := newTestTarget(t, Config{
+		DownloadRewrites: []URLRewrite{{Prefix: "https://example.com/", Replacement: upstream.URL + "/example/"}},
+		DownloadMirrors:  []URLRewrite{{Prefix: "https://example.com/", Replacement: mirror.URL + "/mirror/"}},
+	})
+	defer cleanup()
+
+	path, err := target.Downloader().
+		SetBearerToken("token").
+		SetHeader("X-Api-Key", "key").
+		Download(context.TODO(), "https://example.com/file")
+	require.NoError(t, err)
+	requireFileContent(t, path, "mirrored")
+	require.Equal(t, []string{"/mirror/file"}, paths)
+	// credentials are not sent to mirrors
+	require.Equal(t, []string{""}, auth)
+
+	target.root.DownloadOffline = true
+	cached, err := target.Download(context.TODO(), "https://example.com/file")
+	require.NoError(t, err)
+	require.Equal(t, path, cached)
+	require.Len(t, paths, 1)
+
+	_, err = target.Download(context.TODO(), "https://example.com/other")
+	require.Error(t, err)
+	require.True(t, trace.IsNotFound(err))
+	require.Contains(t, err.Error(), "offline mode")
+}
+
+func TestDownloadHTTPConfig(t *testing.T) {
+	modTime := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	var auth, ifModifiedSince []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		ifModifiedSince = append(ifModifiedSince, r.Header.Get("If-Modified-Since"))
+		http.ServeContent(w, r, "file", modTime, strings.NewReader("content"))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "magnet-ca")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caPath := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(caPath, ca, 0644))
+
+	target, cleanup := newTestTarget(t, Config{DownloadHTTP: HTTPConfig{CABundle: caPath}})
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		path, err := target.Downloader().SetBearerToken("token").Download(context.TODO(), srv.URL)
+		require.NoError(t, err)
+		requireFileContent(t, path, "content")
+	}
+	require.Equal(t, []string{"Bearer token", "Bearer token"}, auth)
+	require.Equal(t, []string{"", modTime.Format(http.TimeFormat)}, ifModifiedSince)
+
+	login, password, ok := parseNetrc(strings.NewReader(`
+machine other.example.com login other password secret
+machine example.com
+  login user
+  password pass
+default login anonymous password none
+`), "example.com")
+	require.True(t, ok)
+	require.Equal(t, "user", login)
+	require.Equal(t, "pass", password)
+}
+
+func TestDownloadVerifiesSignature(t *testing.T) {
+	content := []byte("release")
+	keyID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	_, untrusted, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	sign := func(key ed25519.PrivateKey, algorithm string) string {
+		message := content
+		if algorithm == "ED" {
+			hash := blake2b.Sum512(content)
+			message = hash[:]
+		}
+		sig := append(append([]byte(algorithm), keyID...), ed25519.Sign(key, message)...)
+		comment := "timestamp:1234"
+		global := ed25519.Sign(key, append(sig[10:], comment...))
+		return fmt.Sprintf("untrusted comment: signature\n%v\ntrusted comment: %v\n%v\n",
+			base64.StdEncoding.EncodeToString(sig), comment, base64.StdEncoding.EncodeToString(global))
+	}
+	signatures := map[string]string{
+		"/file.minisig":      sign(private, "Ed"),
+		"/prehashed.minisig": sign(private, "ED"),
+		"/untrusted.minisig": sign(untrusted, "ED"),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sig, ok := signatures[r.URL.Path]; ok {
+			fmt.Fprint(w, sig)
+			return
+		}
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "magnet-keys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "release.pub")
+	key := append(append([]byte("Ed"), keyID...), public...)
+	require.NoError(t, ioutil.WriteFile(keyPath,
+		[]byte("untrusted comment: release key\n"+base64.StdEncoding.EncodeToString(key)+"\n"), 0644))
+
+	lockPath := filepath.Join(dir, "downloads.lock")
+	target, cleanup := newTestTarget(t, Config{DownloadLockFile: lockPath})
+	defer cleanup()
+
+	path, err := target.Downloader().SetSignature(srv.URL+"/file.minisig", keyPath).Download(context.TODO(), srv.URL+"/file")
+	require.NoError(t, err)
+	metadata, err := getMetadata(path)
+	require.NoError(t, err)
+	require.Equal(t, "0807060504030201", metadata.SignatureKeyID)
+
+	_, err = target.Downloader().SetSignature(srv.URL+"/prehashed.minisig", keyPath).Download(context.TODO(), srv.URL+"/prehashed")
+	require.NoError(t, err)
+
+	_, err = target.Downloader().SetSignature(srv.URL+"/untrusted.minisig", keyPath).Download(context.TODO(), srv.URL+"/other")
+	require.Error(t, err)
+	require.True(t, trace.IsAccessDenied(err))
+
+	// only files with a valid signature are recorded in the lock file
+	lock, err := loadDownloadLock(lockPath)
+	require.NoError(t, err)
+	require.NotEmpty(t, lock.get(srv.URL+"/file"))
+	require.Empty(t, lock.get(srv.URL+"/other"))
+}
+
+func TestDownloadVerifiesPGPSignatureOnce(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not available")
+	}
+	home, err := ioutil.TempDir("", "magnet-gpg")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	defer exec.Command("gpgconf", "--homedir", home, "--kill", "all").Run() //nolint:errcheck
+	gpg := func(args ...string) []byte {
+		out, err := exec.Command("gpg", append([]string{"--homedir", home, "--batch", "--pinentry-mode", "loopback", "--passphrase", ""}, args...)...).Output()
+		require.NoError(t, err, "gpg %v", args)
+		return out
+	}
+
+	content := filepath.Join(home, "release")
+	require.NoError(t, ioutil.WriteFile(content, []byte("release"), 0644))
+	gpg("--quick-gen-key", "Release <release@example.com>", "ed25519", "sign", "never")
+	keyPath := filepath.Join(home, "release.asc")
+	require.NoError(t, ioutil.WriteFile(keyPath, gpg("--armor", "--export"), 0644))
+	signature := gpg("--armor", "--detach-sign", "--output", "-", content)
+
+	modTime := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	var signatureRequests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/release.asc" {
+			signatureRequests++
+			w.Write(signature)
+			return
+		}
+		http.ServeContent(w, r, "release", modTime, strings.NewReader("release"))
+	}))
+	defer srv.Close()
+
+	target, cleanup := newTestTarget(t, Config{})
+	defer cleanup()
+
+	path, err := target.Downloader().SetSignature(srv.URL+"/release.asc", keyPath).Download(context.TODO(), srv.URL+"/release")
+	require.NoError(t, err)
+	metadata, err := getMetadata(path)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(metadata.SignatureKeyID, "pgp:"))
+
+	// the signature of the unchanged file is not fetched again, even in offline mode
+	_, err = target.Downloader().SetSignature(srv.URL+"/release.asc", keyPath).Download(context.TODO(), srv.URL+"/release")
+	require.NoError(t, err)
+	target.root.DownloadOffline = true
+	_, err = target.Downloader().SetSignature(srv.URL+"/release.asc", keyPath).Download(context.TODO(), srv.URL+"/release")
+	require.NoError(t, err)
+	require.Equal(t, 1, signatureRequests)
+
+	// unverified signatures are not fetched in offline mode
+	metadata.SignatureKeyID = ""
+	require.NoError(t, writeMetadata(metadata, path))
+	_, err = target.Downloader().SetSignature(srv.URL+"/release.asc", keyPath).Download(context.TODO(), srv.URL+"/release")
+	require.True(t, trace.IsNotFound(err))
+	require.Equal(t, 1, signatureRequests)
+}
+
+func newTarGz(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0755,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func newGz(t *testing.T, content string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+// newTestTarget creates a target for tests with the output discarded
+func newTestTarget(t *testing.T, c Config) (target *MagnetTarget, cleanup func()) {
+	dir, err := ioutil.TempDir("", "magnet-cache")
+	require.NoError(t, err)
+	if c.CacheDir == "" {
+		c.CacheDir = dir
+	}
+
+	status := make(chan *progressui.SolveStatus)
+	go func() {
+		for range status {
+		}
+	}()
+	m := &Magnet{
+		Config: c,
+		status: status,
+	}
+	m.root = MagnetTarget{
+		root:   m,
+		vertex: &progressui.Vertex{Digest: digest.FromString("root")},
+	}
+	m.initOutputOnce.Do(func() {})
+
+	target = m.root.newTarget(&progressui.Vertex{
+		Digest: digest.FromString(t.Name()),
+		Name:   t.Name(),
+	})
+	return target, func() {
+		close(status)
+		os.RemoveAll(dir)
+	}
+}
+
+func requireFileContent(t *testing.T, path, content string) {
+	buf, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, content, string(buf))
+}
@@ -3,11 +3,17 @@ package magnet
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/gravitational/magnet/pkg/cp"
 	"github.com/gravitational/trace"
+	"github.com/opencontainers/go-digest"
 )
 
 // DockerConfigCommon holds common configuration for docker commands.
@@ -16,6 +22,47 @@ type DockerConfigCommon struct {
 
 	// Env are environment variables to pass to the spawned docker command
 	Env map[string]string
+
+	// Backend optionally selects how docker is invoked: DockerBackendCLI or DockerBackendAPI.
+	// Defaults to Config.DockerBackend
+	Backend string
+}
+
+// backend returns the configured docker backend
+func (m *DockerConfigCommon) backend() string {
+	if m.Backend != "" {
+		return m.Backend
+	}
+	if m.target.root.DockerBackend != "" {
+		return m.target.root.DockerBackend
+	}
+	return DockerBackendCLI
+}
+
+// DockerBuildResult describes the result of a docker build
+type DockerBuildResult struct {
+	// ImageID specifies the ID of the built image
+	ImageID string
+	// Digest specifies the digest of the image manifest (or the manifest list
+	// of a multi-platform build). Only set for buildx builds
+	Digest string
+	// ConfigDigest specifies the digest of the image configuration. Only set for buildx builds
+	ConfigDigest string
+	// Metadata specifies the build result metadata reported by buildx
+	Metadata map[string]interface{}
+	// ContextDigest specifies the digest of the build context and parameters
+	ContextDigest digest.Digest
+	// Cached specifies whether the build has been skipped because the image is up to date
+	Cached bool
+}
+
+// DockerRunResult describes the result of running a docker container
+type DockerRunResult struct {
+	// ContainerID specifies the ID of the container
+	ContainerID string
+	// ExitCode specifies the exit code of the container.
+	// Not set for detached containers
+	ExitCode int
 }
 
 // DockerConfigBuild holds configuration for building docker containers.
@@ -31,7 +78,8 @@ type DockerConfigBuild struct {
 	Tag []string
 	// BuildArgs set build-time variables
 	BuildArgs map[string]string
-	// Dockerfile is the path to the Dockerfile to build
+	// Dockerfile is the path to the Dockerfile to build.
+	// A relative path is resolved against the build context directory
 	Dockerfile string
 	// Target sets the target build stage to build
 	Target string
@@ -41,6 +89,35 @@ type DockerConfigBuild struct {
 
 	// ContextCopyConfigs is a list of copy operations to build a custom docker context
 	ContextCopyConfigs []cp.Config
+
+	// RawProgress decodes the BuildKit progress and displays each build step as a child
+	// of the target (Default: true). Requires BuildKit and the CLI backend.
+	// Falls back to plain progress output if the docker CLI does not support the rawjson format
+	RawProgress bool
+	// Platforms lists the target platforms of a multi-platform build (e.g. linux/amd64)
+	Platforms []string
+	// Outputs lists the export destinations of the build result
+	Outputs []DockerBuildOutput
+	// Push pushes the built image to the registry
+	Push bool
+	// Load loads the built image into the docker daemon
+	Load bool
+	// Builder selects the buildx builder instance
+	Builder string
+	// IIDFile optionally specifies the path to write the image ID to
+	IIDFile string
+	// MetadataFile optionally specifies the path to write the build result metadata to
+	MetadataFile string
+	// Secrets lists the secrets exposed to the build. Requires BuildKit and the CLI backend
+	Secrets []DockerBuildSecret
+	// SSH lists the SSH agents forwarded to the build. Requires BuildKit and the CLI backend
+	SSH []DockerBuildSSH
+	// Labels sets metadata on the built image
+	Labels map[string]string
+	// SkipUnchanged skips the build if the tagged images have been built from the same
+	// context, Dockerfile and build parameters (Default: false).
+	// Changes to the base images are not detected and are not pulled if the build is skipped
+	SkipUnchanged bool
 }
 
 // DockerBuild creates a command for building a docker container using buildkit.
@@ -53,8 +130,9 @@ func (m *MagnetTarget) DockerBuild() *DockerConfigBuild {
 				"PROGRESS_NO_TRUNC": "1",
 			},
 		},
-		Pull:     true,
-		Compress: true,
+		Pull:        true,
+		Compress:    true,
+		RawProgress: true,
 	}
 }
 
@@ -81,6 +159,23 @@ func (m *DockerConfigBuild) SetBuildArg(key, value string) *DockerConfigBuild {
 	return m
 }
 
+// SetLabel sets a label on the built image.
+func (m *DockerConfigBuild) SetLabel(key, value string) *DockerConfigBuild {
+	if m.Labels == nil {
+		m.Labels = make(map[string]string)
+	}
+
+	m.Labels[key] = value
+
+	return m
+}
+
+// SetSkipUnchanged sets whether the build is skipped if the context and build parameters are unchanged.
+func (m *DockerConfigBuild) SetSkipUnchanged(skip bool) *DockerConfigBuild {
+	m.SkipUnchanged = skip
+	return m
+}
+
 // SetEnv sets an environment variable on the docker build command.
 func (m *DockerConfigBuild) SetEnv(key, value string) *DockerConfigBuild {
 	if m.Env == nil {
@@ -106,6 +201,7 @@ func (m *DockerConfigBuild) SetEnvs(envs map[string]string) *DockerConfigBuild {
 }
 
 // SetDockerfile sets the name of the Dockerfile (Default is PATH/Dockerfile).
+// A relative path is resolved against the build context directory.
 func (m *DockerConfigBuild) SetDockerfile(dockerfile string) *DockerConfigBuild {
 	m.Dockerfile = dockerfile
 	return m
@@ -135,6 +231,18 @@ func (m *DockerConfigBuild) SetTarget(target string) *DockerConfigBuild {
 	return m
 }
 
+// SetRawProgress sets whether the BuildKit progress is displayed as child vertices of the target.
+func (m *DockerConfigBuild) SetRawProgress(raw bool) *DockerConfigBuild {
+	m.RawProgress = raw
+	return m
+}
+
+// SetBackend sets the backend used to build the image (DockerBackendCLI or DockerBackendAPI).
+func (m *DockerConfigBuild) SetBackend(backend string) *DockerConfigBuild {
+	m.Backend = backend
+	return m
+}
+
 // CopyToContext creates a new docker context directory structure, including only the files that match
 // the provided glob patterns.
 // Notes:
@@ -161,13 +269,81 @@ func (m *DockerConfigBuild) CopyToContext(src, dst string, includePatterns, excl
 
 // Build calls docker to build a container image.
 func (m *DockerConfigBuild) Build(ctx context.Context, contextPath string) error {
-	args := []string{"build"}
+	_, err := m.BuildImage(ctx, contextPath)
+	return trace.Wrap(err)
+}
+
+// BuildImage builds a container image and returns the ID of the built image.
+// If SkipUnchanged is set and all tagged images have been built from the same context and parameters,
+// the build is skipped and the target is marked as cached.
+func (m *DockerConfigBuild) BuildImage(ctx context.Context, contextPath string) (*DockerBuildResult, error) {
+	buildContext, dockerfile, err := m.buildContext(contextPath)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	labels := make(map[string]string, len(m.Labels)+1)
+	for key, value := range m.Labels {
+		labels[key] = value
+	}
+	var contextDigest digest.Digest
+	if m.SkipUnchanged && len(m.Tag) != 0 {
+		contextDigest, err = m.contextDigest(buildContext, dockerfile)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		labels[DockerContextDigestLabel] = contextDigest.String()
+
+		// skipping an export or push would leave the destination without the image
+		if !m.NoCache && !m.buildx() {
+			result, err := m.findUnchanged(ctx, contextDigest)
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+			if result != nil {
+				m.target.Printlnf("Image %v is up to date (context %v)", strings.Join(m.Tag, ", "), contextDigest)
+				m.target.SetCached(true)
+				return result, nil
+			}
+		}
+	}
+
+	result, err := m.build(ctx, buildContext, dockerfile, labels)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	result.ContextDigest = contextDigest
+	return result, nil
+}
+
+func (m *DockerConfigBuild) build(ctx context.Context, buildContext *dockerContext, dockerfile string, labels map[string]string) (*DockerBuildResult, error) {
+	if m.backend() == DockerBackendAPI {
+		if m.buildx() {
+			return nil, trace.NotImplemented("multi-platform builds and outputs require the CLI backend")
+		}
+		if len(m.Secrets) != 0 || len(m.SSH) != 0 {
+			return nil, trace.NotImplemented("build secrets and SSH forwarding require the CLI backend")
+		}
+		result, err := m.buildAPI(ctx, buildContext, dockerfile, labels)
+		return result, trace.Wrap(err)
+	}
+	result, err := m.buildCLI(ctx, buildContext, dockerfile, labels)
+	return result, trace.Wrap(err)
+}
+
+func (m *DockerConfigBuild) buildCLI(ctx context.Context, buildContext *dockerContext, dockerfile string, labels map[string]string) (*DockerBuildResult, error) {
+	command := []string{"build"}
+
+	if m.buildx() {
+		command = []string{"buildx", "build"}
+	}
+	args := append([]string(nil), command...)
 
 	if m.Pull {
 		args = append(args, "--pull")
 	}
 
-	if m.Compress {
+	if m.Compress && !m.buildx() {
 		args = append(args, "--compress")
 	}
 
@@ -187,67 +363,138 @@ func (m *DockerConfigBuild) Build(ctx context.Context, contextPath string) error
 		args = append(args, "--cache-from", value)
 	}
 
+	for key, value := range labels {
+		args = append(args, "--label", fmt.Sprint(key, "=", value))
+	}
+
 	for _, value := range m.Tag {
 		args = append(args, "-t", value)
 	}
 
-	if len(m.ContextCopyConfigs) != 0 {
-		newContextPath, err := ioutil.TempDir("", "docker-context")
-		if err != nil {
-			return trace.Wrap(err)
-		}
+	if len(dockerfile) > 0 {
+		args = append(args, "-f", dockerfile)
+	}
 
-		for _, c := range m.ContextCopyConfigs {
-			// We want any copy operation to be relative to our context destination directory
-			c.Destination = filepath.Join(newContextPath, c.Destination)
+	tmp, err := ioutil.TempDir("", "docker-build")
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	defer os.RemoveAll(tmp)
 
-			err = cp.Copy(c)
-			if err != nil {
-				return trace.Wrap(err)
-			}
-		}
+	iidfile := m.IIDFile
+	if iidfile == "" {
+		iidfile = filepath.Join(tmp, "iid")
+	} else if err := os.Remove(iidfile); err != nil && !os.IsNotExist(err) {
+		// a stale image ID must not be mistaken for the result of this build
+		return nil, trace.ConvertSystemError(err)
+	}
+	args = append(args, "--iidfile", iidfile)
 
-		if len(m.Dockerfile) > 0 {
-			if filepath.IsAbs(m.Dockerfile) {
-				err = cp.Copy(cp.Config{
-					Source:      m.Dockerfile,
-					Destination: filepath.Join(newContextPath, "Dockerfile"),
-				})
-				if err != nil {
-					return trace.Wrap(err)
-				}
-			} else {
-				err = cp.Copy(cp.Config{
-					Source:      filepath.Join(contextPath, m.Dockerfile),
-					Destination: filepath.Join(newContextPath, "Dockerfile"),
-				})
-				if err != nil {
-					return trace.Wrap(err)
-				}
-			}
+	metadataFile := m.MetadataFile
+	if metadataFile == "" {
+		metadataFile = filepath.Join(tmp, "metadata.json")
+	}
+	if m.buildx() {
+		args = append(args, m.buildxArgs(metadataFile)...)
+	}
+
+	secretArgs, secretEnv, err := m.secretArgs()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	args = append(args, secretArgs...)
 
+	cmd := m.target.Exec().SetEnvs(m.Env).SetEnvs(secretEnv)
+	if m.RawProgress && (m.buildx() || m.Env["DOCKER_BUILDKIT"] == "1") {
+		if m.target.root.supportsRawProgress(ctx, m.Env, command...) {
+			progress := newBuildkitProgressWriter(m.target)
+			defer progress.Close()
+			args = append(args, "--progress=rawjson")
+			cmd.SetStderr(progress)
 		} else {
-			err = cp.Copy(cp.Config{
-				Source:      filepath.Join(contextPath, "Dockerfile"),
-				Destination: filepath.Join(newContextPath, "Dockerfile"),
-			})
-			if err != nil {
-				return trace.Wrap(err)
-			}
+			m.target.Println("The docker CLI does not support raw progress output, falling back to plain progress.")
+			args = append(args, "--progress=plain")
 		}
+	}
 
-		contextPath = newContextPath
+	if buildContext.dir != "" {
+		args = append(args, buildContext.dir)
 	} else {
-		if len(m.Dockerfile) > 0 {
-			args = append(args, "-f", m.Dockerfile)
+		// stream the custom context to docker
+		m.target.Printlnf("Build context: %v files", len(buildContext.files))
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(buildContext.writeTar(pw))
+		}()
+		defer pr.Close()
+		cmd.SetStdin(pr)
+		args = append(args, "-")
+	}
+
+	_, err = cmd.Run(ctx, "docker", args...)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	result := &DockerBuildResult{}
+	imageID, err := ioutil.ReadFile(iidfile)
+	switch {
+	case err == nil:
+		result.ImageID = strings.TrimSpace(string(imageID))
+	case os.IsNotExist(err) && m.exportOnly():
+		// the image ID is not written if the result is only exported (e.g. to a local directory)
+	default:
+		return nil, trace.ConvertSystemError(err)
+	}
+
+	if m.buildx() {
+		if err := readBuildMetadata(metadataFile, result); err != nil {
+			return nil, trace.Wrap(err)
 		}
 	}
 
-	args = append(args, contextPath)
+	return result, nil
+}
 
-	_, err := m.target.Exec().SetEnvs(m.Env).Run(ctx, "docker", args...)
+func (m *DockerConfigBuild) buildAPI(ctx context.Context, buildContext *dockerContext, dockerfile string, labels map[string]string) (*DockerBuildResult, error) {
+	client, err := m.target.root.DockerClient()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
 
-	return trace.Wrap(err)
+	if dockerfile != "" {
+		// the API expects the Dockerfile relative to the context
+		name, ok := contextName(buildContext.dir, dockerfile)
+		if !ok {
+			return nil, trace.BadParameter("Dockerfile %v outside of the build context requires the CLI backend", dockerfile)
+		}
+		dockerfile = name
+	}
+
+	m.target.Printlnf("Docker API build: %v (%v files)", buildContext.dir, len(buildContext.files))
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(buildContext.writeTar(pw))
+	}()
+	defer pr.Close()
+
+	stdout, _ := outStreams(m.target.vertex.Digest, m.target.root.status)
+	imageID, err := client.imageBuild(ctx, pr, dockerBuildOptions{
+		tags:       m.Tag,
+		dockerfile: dockerfile,
+		target:     m.Target,
+		buildArgs:  m.BuildArgs,
+		labels:     labels,
+		cacheFrom:  m.CacheFrom,
+		pull:       m.Pull,
+		noCache:    m.NoCache,
+	}, stdout)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &DockerBuildResult{ImageID: imageID}, nil
 }
 
 // DockerBindMount represents a mount point that can be passed when running a docker container
@@ -268,6 +515,23 @@ type DockerBindMount struct {
 	Consistency string
 }
 
+func (b DockerBindMount) mount() dockerMount {
+	mount := dockerMount{
+		Type:        b.Type,
+		Source:      b.Source,
+		Target:      b.Destination,
+		ReadOnly:    b.Readonly,
+		Consistency: b.Consistency,
+	}
+	if mount.Type == "" {
+		mount.Type = "bind"
+	}
+	if b.BindPropagation != "" {
+		mount.BindOptions = &struct{ Propagation string }{Propagation: b.BindPropagation}
+	}
+	return mount
+}
+
 func (b DockerBindMount) arg() string {
 	if b.Type == "" {
 		b.Type = "bind"
@@ -402,8 +666,30 @@ func (m *DockerConfigRun) SetNetwork(network string) *DockerConfigRun {
 	return m
 }
 
-// Run calls docker by cli to run the configured container.
+// SetBackend sets the backend used to run the container (DockerBackendCLI or DockerBackendAPI).
+func (m *DockerConfigRun) SetBackend(backend string) *DockerConfigRun {
+	m.Backend = backend
+	return m
+}
+
+// Run calls docker to run the configured container.
 func (m *DockerConfigRun) Run(ctx context.Context, image, cmd string, cargs ...string) error {
+	_, err := m.RunContainer(ctx, image, cmd, cargs...)
+	return trace.Wrap(err)
+}
+
+// RunContainer runs the configured container and returns the container ID and exit code.
+// A non-zero exit code is returned as an error along with the result.
+func (m *DockerConfigRun) RunContainer(ctx context.Context, image, cmd string, cargs ...string) (*DockerRunResult, error) {
+	if m.backend() == DockerBackendAPI {
+		result, err := m.runAPI(ctx, image, cmd, cargs...)
+		return result, trace.Wrap(err)
+	}
+	result, err := m.runCLI(ctx, image, cmd, cargs...)
+	return result, trace.Wrap(err)
+}
+
+func (m *DockerConfigRun) runCLI(ctx context.Context, image, cmd string, cargs ...string) (*DockerRunResult, error) {
 	args := []string{"run"}
 
 	if m.Detach {
@@ -446,11 +732,107 @@ func (m *DockerConfigRun) Run(ctx context.Context, image, cmd string, cargs ...s
 		args = append(args, fmt.Sprintf("--env=%v=%v", key, value))
 	}
 
+	// docker refuses to overwrite an existing cidfile, so only reserve a unique name
+	dir, err := ioutil.TempDir("", "docker-cid")
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	defer os.RemoveAll(dir)
+	cidfile := filepath.Join(dir, "cid")
+	args = append(args, "--cidfile", cidfile)
+
 	args = append(args, image)
 	args = append(args, cmd)
 	args = append(args, cargs...)
 
-	_, err := m.target.Exec().Run(ctx, "docker", args...)
+	_, err = m.target.Exec().Run(ctx, "docker", args...)
 
-	return trace.Wrap(err)
+	result := &DockerRunResult{}
+	if id, rerr := ioutil.ReadFile(cidfile); rerr == nil {
+		result.ContainerID = strings.TrimSpace(string(id))
+	}
+	if exitErr, ok := trace.Unwrap(err).(*exec.ExitError); ok {
+		result.ExitCode = exitErr.ExitCode()
+	}
+
+	return result, trace.Wrap(err)
+}
+
+func (m *DockerConfigRun) runAPI(ctx context.Context, image, cmd string, cargs ...string) (*DockerRunResult, error) {
+	client, err := m.target.root.DockerClient()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	config := dockerContainerConfig{
+		Image:      image,
+		Cmd:        append([]string{cmd}, cargs...),
+		WorkingDir: m.WorkDir,
+		HostConfig: dockerHostConfig{
+			Privileged:     m.Privileged,
+			ReadonlyRootfs: m.ReadOnly,
+			NetworkMode:    m.Network,
+			// detached containers are removed by the daemon once they exit
+			AutoRemove: m.Remove && m.Detach,
+		},
+	}
+	if len(m.UID) > 0 {
+		config.User = m.UID
+		if len(m.GID) > 0 {
+			config.User = fmt.Sprint(m.UID, ":", m.GID)
+		}
+	}
+	for key, value := range m.Env {
+		config.Env = append(config.Env, fmt.Sprintf("%v=%v", key, value))
+	}
+	sort.Strings(config.Env)
+	for _, value := range m.Volumes {
+		config.HostConfig.Mounts = append(config.HostConfig.Mounts, value.mount())
+	}
+
+	m.target.Println("Docker API run: ", image, " ", strings.Join(config.Cmd, " "))
+
+	id, err := client.containerCreate(ctx, config)
+	if trace.IsNotFound(err) {
+		// pull the missing image as docker run does
+		m.target.Printlnf("Unable to find image %v locally", image)
+		if _, err := m.target.DockerPull(ctx, image); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		id, err = client.containerCreate(ctx, config)
+	}
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	result := &DockerRunResult{ContainerID: id}
+
+	if m.Remove && !m.Detach {
+		defer func() {
+			if err := client.containerRemove(context.Background(), id); err != nil {
+				m.target.Println("Failed to remove container ", id, ": ", err)
+			}
+		}()
+	}
+
+	if err := client.containerStart(ctx, id); err != nil {
+		return result, trace.Wrap(err)
+	}
+	if m.Detach {
+		return result, nil
+	}
+
+	stdout, stderr := outStreams(m.target.vertex.Digest, m.target.root.status)
+	if err := client.containerLogs(ctx, id, stdout, stderr); err != nil {
+		return result, trace.Wrap(err)
+	}
+
+	result.ExitCode, err = client.containerWait(ctx, id)
+	if err != nil {
+		return result, trace.Wrap(err)
+	}
+	if result.ExitCode != 0 {
+		return result, trace.BadParameter("container %v exited with code %v", id, result.ExitCode)
+	}
+
+	return result, nil
 }
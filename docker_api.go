@@ -0,0 +1,528 @@
+package magnet
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gravitational/trace"
+)
+
+const (
+	// DockerBackendCLI runs docker commands with the docker CLI
+	DockerBackendCLI = "cli"
+	// DockerBackendAPI talks to the Docker Engine API directly
+	DockerBackendAPI = "api"
+)
+
+// DefaultDockerHost specifies the default address of the Docker Engine API
+const DefaultDockerHost = "unix:///var/run/docker.sock"
+
+// dockerAPIVersion specifies the version of the Docker Engine API used by the client
+const dockerAPIVersion = "v1.40"
+
+// DockerClient is a minimal client for the Docker Engine API
+type DockerClient struct {
+	client *http.Client
+	// base specifies the base URL of API requests
+	base string
+}
+
+// DockerTLSConfig configures TLS for the Docker Engine API on a TCP address
+type DockerTLSConfig struct {
+	// CertPath specifies the directory with the client certificate (cert.pem),
+	// the client key (key.pem) and the CA certificate (ca.pem)
+	CertPath string
+	// Verify specifies whether to verify the daemon certificate against the CA certificate
+	Verify bool
+}
+
+// NewDockerClient creates a new client for the Docker Engine API at host.
+// host is either a unix socket (unix:///var/run/docker.sock) or a TCP address (tcp://localhost:2375).
+// If tlsConfig is specified, TCP addresses are accessed over TLS
+func NewDockerClient(host string, tlsConfig *DockerTLSConfig) (*DockerClient, error) {
+	if host == "" {
+		host = DefaultDockerHost
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, trace.BadParameter("invalid docker host %q: %v", host, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		return &DockerClient{
+			client: &http.Client{Transport: transport},
+			base:   "http://docker",
+		}, nil
+	case "tcp", "http", "https":
+		if tlsConfig == nil && u.Scheme != "https" {
+			return &DockerClient{
+				client: &http.Client{},
+				base:   "http://" + u.Host,
+			}, nil
+		}
+		config, err := tlsConfig.clientConfig()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return &DockerClient{
+			client: &http.Client{Transport: &http.Transport{TLSClientConfig: config}},
+			base:   "https://" + u.Host,
+		}, nil
+	}
+	return nil, trace.BadParameter("unsupported docker host %q, expected unix:// or tcp://", host)
+}
+
+// defaultDockerTLS returns the TLS configuration from DOCKER_CERT_PATH and DOCKER_TLS_VERIFY
+// with the same semantics as the docker CLI: TLS is only used if DOCKER_TLS_VERIFY is set,
+// DOCKER_CERT_PATH alone has no effect. Returns nil if TLS is not configured
+func defaultDockerTLS() *DockerTLSConfig {
+	return dockerTLSFromEnv(dockerCertPath, dockerTLSVerify)
+}
+
+func dockerTLSFromEnv(certPath, verify string) *DockerTLSConfig {
+	if verify == "" {
+		return nil
+	}
+	if certPath == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			certPath = filepath.Join(home, ".docker")
+		}
+	}
+	return &DockerTLSConfig{
+		CertPath: certPath,
+		Verify:   true,
+	}
+}
+
+// clientConfig returns the TLS configuration with the certificates from CertPath.
+// A nil config results in the default TLS configuration
+func (r *DockerTLSConfig) clientConfig() (*tls.Config, error) {
+	if r == nil {
+		return &tls.Config{}, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: !r.Verify}
+	if r.CertPath == "" {
+		return config, nil
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(r.CertPath, "cert.pem"), filepath.Join(r.CertPath, "key.pem"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, trace.Wrap(err, "failed to load the docker client certificate from %v", r.CertPath)
+	}
+	if err == nil {
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if r.Verify {
+		ca, err := ioutil.ReadFile(filepath.Join(r.CertPath, "ca.pem"))
+		if err != nil {
+			return nil, trace.ConvertSystemError(err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, trace.BadParameter("no certificates found in %v", filepath.Join(r.CertPath, "ca.pem"))
+		}
+	}
+	return config, nil
+}
+
+// Ping verifies the API is reachable
+func (c *DockerClient) Ping(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodGet, "/_ping", nil, nil, nil)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(resp.Body.Close())
+}
+
+// DockerImage describes a local image
+type DockerImage struct {
+	// ID specifies the image ID
+	ID string
+	// RepoTags lists the tags of the image
+	RepoTags []string
+	// RepoDigests lists the repository digests of the image
+	RepoDigests []string
+	// Labels specifies the image labels
+	Labels map[string]string
+}
+
+// ImageInspect returns the local image with the given name or ID
+func (c *DockerClient) ImageInspect(ctx context.Context, image string) (*DockerImage, error) {
+	var result dockerImageJSON
+	if err := c.getJSON(ctx, "/images/"+image+"/json", nil, &result); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return result.image(), nil
+}
+
+// dockerImageJSON defines the image as returned by the inspect API and command
+type dockerImageJSON struct {
+	ID          string `json:"Id"`
+	RepoTags    []string
+	RepoDigests []string
+	Config      struct {
+		Labels map[string]string
+	}
+}
+
+func (r dockerImageJSON) image() *DockerImage {
+	return &DockerImage{
+		ID:          r.ID,
+		RepoTags:    r.RepoTags,
+		RepoDigests: r.RepoDigests,
+		Labels:      r.Config.Labels,
+	}
+}
+
+// dockerBuildOptions specifies the parameters of the image build
+type dockerBuildOptions struct {
+	tags       []string
+	dockerfile string
+	target     string
+	buildArgs  map[string]string
+	labels     map[string]string
+	cacheFrom  []string
+	pull       bool
+	noCache    bool
+}
+
+// imageBuild builds the image from the tar build context and returns the image ID.
+// The build output is written to w
+func (c *DockerClient) imageBuild(ctx context.Context, buildContext io.Reader, opts dockerBuildOptions, w io.Writer) (imageID string, err error) {
+	query := url.Values{}
+	for _, tag := range opts.tags {
+		query.Add("t", tag)
+	}
+	if opts.dockerfile != "" {
+		query.Set("dockerfile", opts.dockerfile)
+	}
+	if opts.target != "" {
+		query.Set("target", opts.target)
+	}
+	if opts.pull {
+		query.Set("pull", "1")
+	}
+	if opts.noCache {
+		query.Set("nocache", "1")
+	}
+	query.Set("rm", "1")
+	for key, value := range map[string]interface{}{
+		"buildargs": opts.buildArgs,
+		"labels":    opts.labels,
+		"cachefrom": opts.cacheFrom,
+	} {
+		buf, err := json.Marshal(value)
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+		query.Set(key, string(buf))
+	}
+
+	header := http.Header{"Content-Type": []string{"application/x-tar"}}
+	resp, err := c.do(ctx, http.MethodPost, "/build", query, buildContext, header)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+
+	err = decodeJSONMessages(resp.Body, func(msg jsonMessage) error {
+		if msg.Stream != "" {
+			_, _ = io.WriteString(w, msg.Stream)
+		}
+		var aux struct {
+			ID string
+		}
+		if len(msg.Aux) != 0 && json.Unmarshal(msg.Aux, &aux) == nil && aux.ID != "" {
+			imageID = aux.ID
+		}
+		return nil
+	})
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	if imageID == "" {
+		return "", trace.BadParameter("docker build did not return an image ID")
+	}
+	return imageID, nil
+}
+
+// dockerContainerConfig defines the container to create
+type dockerContainerConfig struct {
+	Image      string
+	Cmd        []string
+	Env        []string `json:",omitempty"`
+	User       string   `json:",omitempty"`
+	WorkingDir string   `json:",omitempty"`
+	HostConfig dockerHostConfig
+}
+
+type dockerHostConfig struct {
+	Privileged     bool          `json:",omitempty"`
+	ReadonlyRootfs bool          `json:",omitempty"`
+	NetworkMode    string        `json:",omitempty"`
+	Mounts         []dockerMount `json:",omitempty"`
+	// AutoRemove removes the container when it exits
+	AutoRemove bool `json:",omitempty"`
+}
+
+type dockerMount struct {
+	Type        string
+	Source      string `json:",omitempty"`
+	Target      string
+	ReadOnly    bool   `json:",omitempty"`
+	Consistency string `json:",omitempty"`
+	BindOptions *struct {
+		Propagation string
+	} `json:",omitempty"`
+}
+
+// containerCreate creates the container and returns its ID
+func (c *DockerClient) containerCreate(ctx context.Context, config dockerContainerConfig) (id string, err error) {
+	var result struct {
+		ID       string `json:"Id"`
+		Warnings []string
+	}
+	if err := c.postJSON(ctx, "/containers/create", nil, config, &result); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return result.ID, nil
+}
+
+func (c *DockerClient) containerStart(ctx context.Context, id string) error {
+	return trace.Wrap(c.postJSON(ctx, "/containers/"+id+"/start", nil, nil, nil))
+}
+
+// containerLogs follows the output of the container until it exits
+func (c *DockerClient) containerLogs(ctx context.Context, id string, stdout, stderr io.Writer) error {
+	query := url.Values{"follow": {"1"}, "stdout": {"1"}, "stderr": {"1"}}
+	resp, err := c.do(ctx, http.MethodGet, "/containers/"+id+"/logs", query, nil, nil)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	return trace.Wrap(demuxDockerStream(resp.Body, stdout, stderr))
+}
+
+// containerWait waits for the container to exit and returns its exit code
+func (c *DockerClient) containerWait(ctx context.Context, id string) (exitCode int, err error) {
+	var result struct {
+		StatusCode int
+		Error      *struct {
+			Message string
+		}
+	}
+	if err := c.postJSON(ctx, "/containers/"+id+"/wait", nil, nil, &result); err != nil {
+		return 0, trace.Wrap(err)
+	}
+	if result.Error != nil && result.Error.Message != "" {
+		return result.StatusCode, trace.BadParameter(result.Error.Message)
+	}
+	return result.StatusCode, nil
+}
+
+func (c *DockerClient) containerRemove(ctx context.Context, id string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/containers/"+id, url.Values{"force": {"1"}, "v": {"1"}}, nil, nil)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(resp.Body.Close())
+}
+
+func (c *DockerClient) getJSON(ctx context.Context, path string, query url.Values, out interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, path, query, nil, nil)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	return trace.Wrap(json.NewDecoder(resp.Body).Decode(out))
+}
+
+func (c *DockerClient) postJSON(ctx context.Context, path string, query url.Values, in, out interface{}) error {
+	var body io.Reader
+	header := http.Header{}
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		body = bytes.NewReader(buf)
+		header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.do(ctx, http.MethodPost, path, query, body, header)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return trace.Wrap(json.NewDecoder(resp.Body).Decode(out))
+}
+
+// do sends the API request and converts error responses to errors.
+// path is escaped, so it can contain arbitrary image names and IDs
+func (c *DockerClient) do(ctx context.Context, method, path string, query url.Values, body io.Reader, header http.Header) (*http.Response, error) {
+	u := url.URL{
+		Path:     fmt.Sprintf("/%v%v", dockerAPIVersion, path),
+		RawQuery: query.Encode(),
+	}
+	req, err := http.NewRequest(method, c.base+u.String(), body)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, trace.ConnectionProblem(err, "failed to connect to the docker daemon")
+	}
+	if resp.StatusCode < http.StatusBadRequest {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var result struct {
+		Message string `json:"message"`
+	}
+	message := strings.TrimSpace(string(buf))
+	if json.Unmarshal(buf, &result) == nil && result.Message != "" {
+		message = result.Message
+	}
+	return nil, dockerError(resp.StatusCode, message)
+}
+
+func dockerError(statusCode int, message string) error {
+	switch statusCode {
+	case http.StatusNotFound:
+		return trace.NotFound(message)
+	case http.StatusConflict:
+		return trace.AlreadyExists(message)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return trace.AccessDenied(message)
+	case http.StatusNotImplemented:
+		return trace.NotImplemented(message)
+	}
+	return trace.BadParameter("docker API error (%v): %v", statusCode, message)
+}
+
+// jsonMessage is a message in the JSON stream returned by the build, pull and push APIs
+type jsonMessage struct {
+	Stream         string `json:"stream"`
+	Status         string `json:"status"`
+	ID             string `json:"id"`
+	Progress       string `json:"progress"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Aux json.RawMessage `json:"aux"`
+}
+
+// decodeJSONMessages decodes the JSON message stream from r invoking fn for each message.
+// Returns the error reported in the stream
+func decodeJSONMessages(r io.Reader, fn func(jsonMessage) error) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg jsonMessage
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return trace.Wrap(err)
+		}
+		if msg.Error != "" {
+			return trace.BadParameter(msg.Error)
+		}
+		if err := fn(msg); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+}
+
+// demuxDockerStream copies the multiplexed container output from r to stdout and stderr.
+// Each frame starts with an 8-byte header specifying the stream and the size of the payload
+func demuxDockerStream(r io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return trace.Wrap(err)
+		}
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+}
+
+// writeTarEntry writes the file at path described with fi to tw under name
+func writeTarEntry(tw *tar.Writer, path, name string, fi os.FileInfo) error {
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return trace.ConvertSystemError(err)
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return trace.Wrap(err)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return trace.Wrap(err)
+}
+
+// DockerClient returns the client for the Docker Engine API at Config.DockerHost
+func (m *Magnet) DockerClient() (*DockerClient, error) {
+	m.dockerOnce.Do(func() {
+		m.dockerClient, m.dockerClientErr = NewDockerClient(m.DockerHost, m.DockerTLS)
+	})
+	return m.dockerClient, trace.Wrap(m.dockerClientErr)
+}
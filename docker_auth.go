@@ -0,0 +1,167 @@
+package magnet
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gravitational/trace"
+)
+
+// dockerHubAuthKey is the key Docker Hub credentials are stored under in the docker config file
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// dockerAuthConfig describes the credentials for a registry.
+// Sent to the daemon base64-encoded in the X-Registry-Auth header
+type dockerAuthConfig struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+}
+
+// dockerConfigFile defines the subset of the docker CLI configuration file with registry credentials
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// dockerRegistryAuth returns the encoded credentials for the registry of image
+// from the docker CLI configuration file.
+// Credentials are resolved with a credential helper if one is configured.
+// Returns the encoded empty credentials if none are configured
+func dockerRegistryAuth(image string) (string, error) {
+	auth, err := lookupDockerAuth(dockerConfigPath(), registryAuthKey(image))
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	RegisterSecret(auth.Password)
+	RegisterSecret(auth.IdentityToken)
+	buf, err := json.Marshal(auth)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
+
+func lookupDockerAuth(path, registry string) (auth dockerAuthConfig, err error) {
+	auth.ServerAddress = registry
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return auth, nil
+		}
+		return auth, trace.ConvertSystemError(err)
+	}
+	var config dockerConfigFile
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return auth, trace.Wrap(err, "invalid docker config file %v", path)
+	}
+
+	if helper := config.CredHelpers[registry]; helper != "" {
+		return dockerCredentialHelper(helper, registry)
+	}
+	if config.CredsStore != "" {
+		return dockerCredentialHelper(config.CredsStore, registry)
+	}
+
+	for key, entry := range config.Auths {
+		if normalizeRegistry(key) != registry {
+			continue
+		}
+		auth.IdentityToken = entry.IdentityToken
+		if entry.Auth == "" {
+			return auth, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return auth, trace.Wrap(err, "invalid credentials for %v in %v", registry, path)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return auth, trace.BadParameter("invalid credentials for %v in %v", registry, path)
+		}
+		auth.Username, auth.Password = parts[0], parts[1]
+		return auth, nil
+	}
+	return auth, nil
+}
+
+// dockerCredentialHelper resolves the credentials for registry with the
+// docker-credential-<helper> program
+func dockerCredentialHelper(helper, registry string) (auth dockerAuthConfig, err error) {
+	auth.ServerAddress = registry
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(registry)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stdout.String() + stderr.String())
+		// helpers report missing credentials on stdout
+		if strings.Contains(message, "credentials not found") {
+			return auth, nil
+		}
+		return auth, trace.Wrap(err, "credential helper %v failed: %v", helper, message)
+	}
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return auth, trace.Wrap(err, "invalid output of credential helper %v", helper)
+	}
+	// identity tokens are returned with a special username
+	if creds.Username == "<token>" {
+		auth.IdentityToken = creds.Secret
+		return auth, nil
+	}
+	auth.Username, auth.Password = creds.Username, creds.Secret
+	return auth, nil
+}
+
+// dockerConfigPath returns the path to the docker CLI configuration file
+func dockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// registryAuthKey returns the key the credentials for the registry of image
+// are stored under in the docker config file
+func registryAuthKey(image string) string {
+	i := strings.IndexRune(image, '/')
+	if i < 0 {
+		return dockerHubAuthKey
+	}
+	domain := image[:i]
+	if !strings.ContainsAny(domain, ".:") && domain != "localhost" {
+		return dockerHubAuthKey
+	}
+	return normalizeRegistry(domain)
+}
+
+// normalizeRegistry converts the registry address given as a key in the docker config file
+// (e.g. https://registry.example.com/v1/) to the key returned by registryAuthKey
+func normalizeRegistry(address string) string {
+	address = strings.TrimPrefix(strings.TrimPrefix(address, "https://"), "http://")
+	if i := strings.IndexRune(address, '/'); i >= 0 {
+		address = address[:i]
+	}
+	switch address {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return dockerHubAuthKey
+	}
+	return address
+}
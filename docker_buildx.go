@@ -0,0 +1,158 @@
+package magnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/gravitational/trace"
+)
+
+const (
+	// DockerOutputDocker loads the image into the docker daemon
+	DockerOutputDocker = "docker"
+	// DockerOutputImage exports the image to the image store
+	DockerOutputImage = "image"
+	// DockerOutputRegistry pushes the image to the registry
+	DockerOutputRegistry = "registry"
+	// DockerOutputLocal exports the contents of the resulting filesystem to a local directory
+	DockerOutputLocal = "local"
+	// DockerOutputTar exports the contents of the resulting filesystem as a tarball
+	DockerOutputTar = "tar"
+	// DockerOutputOCI exports the image in the OCI image layout as a tarball
+	DockerOutputOCI = "oci"
+)
+
+// DockerBuildOutput describes an export destination of a buildx build
+type DockerBuildOutput struct {
+	// Type specifies the type of the output, e.g. DockerOutputLocal
+	Type string
+	// Dest optionally specifies the destination path
+	Dest string
+	// Attrs optionally specifies additional attributes of the output, e.g. name or compression
+	Attrs map[string]string
+}
+
+// arg formats the output as the value of the --output flag
+func (r DockerBuildOutput) arg() string {
+	attrs := []string{"type=" + r.Type}
+	if r.Dest != "" {
+		attrs = append(attrs, "dest="+r.Dest)
+	}
+	keys := make([]string, 0, len(r.Attrs))
+	for key := range r.Attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		attrs = append(attrs, fmt.Sprintf("%v=%v", key, r.Attrs[key]))
+	}
+	return strings.Join(attrs, ",")
+}
+
+// AddPlatform adds target platforms in the os/arch[/variant] format (e.g. linux/arm64).
+func (m *DockerConfigBuild) AddPlatform(platforms ...string) *DockerConfigBuild {
+	m.Platforms = append(m.Platforms, platforms...)
+	return m
+}
+
+// AddOutput adds an export destination for the build result.
+func (m *DockerConfigBuild) AddOutput(output DockerBuildOutput) *DockerConfigBuild {
+	m.Outputs = append(m.Outputs, output)
+	return m
+}
+
+// SetPush pushes the built image to the registry.
+func (m *DockerConfigBuild) SetPush(push bool) *DockerConfigBuild {
+	m.Push = push
+	return m
+}
+
+// SetLoad loads the built image into the docker daemon.
+func (m *DockerConfigBuild) SetLoad(load bool) *DockerConfigBuild {
+	m.Load = load
+	return m
+}
+
+// SetBuilder selects the buildx builder instance.
+func (m *DockerConfigBuild) SetBuilder(builder string) *DockerConfigBuild {
+	m.Builder = builder
+	return m
+}
+
+// SetIIDFile sets the path to write the image ID to.
+func (m *DockerConfigBuild) SetIIDFile(path string) *DockerConfigBuild {
+	m.IIDFile = path
+	return m
+}
+
+// SetMetadataFile sets the path to write the build result metadata to.
+func (m *DockerConfigBuild) SetMetadataFile(path string) *DockerConfigBuild {
+	m.MetadataFile = path
+	return m
+}
+
+// buildx returns true if the build requires docker buildx
+func (m *DockerConfigBuild) buildx() bool {
+	return len(m.Platforms) != 0 || len(m.Outputs) != 0 || m.Push || m.Load ||
+		m.Builder != "" || m.MetadataFile != ""
+}
+
+// exportOnly returns true if the buildx build produces no image, only exported
+// files (e.g. a local directory or a tarball), in which case no image ID is written
+func (m *DockerConfigBuild) exportOnly() bool {
+	if !m.buildx() || m.Push || m.Load {
+		return false
+	}
+	for _, output := range m.Outputs {
+		switch output.Type {
+		case DockerOutputLocal, DockerOutputTar:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// buildxArgs returns the flags specific to docker buildx build
+func (m *DockerConfigBuild) buildxArgs(metadataFile string) (args []string) {
+	if m.Builder != "" {
+		args = append(args, "--builder", m.Builder)
+	}
+	if len(m.Platforms) != 0 {
+		args = append(args, "--platform", strings.Join(m.Platforms, ","))
+	}
+	for _, output := range m.Outputs {
+		args = append(args, "--output", output.arg())
+	}
+	if m.Push {
+		args = append(args, "--push")
+	}
+	if m.Load {
+		args = append(args, "--load")
+	}
+	return append(args, "--metadata-file", metadataFile)
+}
+
+// readBuildMetadata reads the buildx metadata file into result
+func readBuildMetadata(path string, result *DockerBuildResult) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(buf, &result.Metadata); err != nil {
+		return trace.Wrap(err, "invalid build metadata file %v", path)
+	}
+	if d, ok := result.Metadata["containerimage.digest"].(string); ok {
+		result.Digest = d
+	}
+	if d, ok := result.Metadata["containerimage.config.digest"].(string); ok {
+		result.ConfigDigest = d
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package magnet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"github.com/opencontainers/go-digest"
+)
+
+// DockerContextDigestLabel names the image label with the digest of the build context and parameters
+const DockerContextDigestLabel = "io.magnet.context-digest"
+
+// contextDigest computes the digest over the effective build context, the Dockerfile
+// and the build parameters affecting the resulting image
+func (m *DockerConfigBuild) contextDigest(buildContext *dockerContext, dockerfile string) (digest.Digest, error) {
+	digester := digest.Canonical.Digester()
+	h := digester.Hash()
+
+	for _, f := range buildContext.files {
+		fmt.Fprintf(h, "file %q %o\n", f.name, f.fi.Mode())
+		if err := hashContextFile(h, f.path, f.fi); err != nil {
+			return "", trace.Wrap(err)
+		}
+	}
+
+	if dockerfile != "" {
+		fi, err := os.Stat(dockerfile)
+		if err != nil {
+			return "", trace.ConvertSystemError(err)
+		}
+		// identify the Dockerfile within the context independently of the location of the context
+		name, ok := contextName(buildContext.dir, dockerfile)
+		if !ok {
+			name = dockerfile
+		}
+		fmt.Fprintf(h, "dockerfile %q\n", name)
+		if err := hashContextFile(h, dockerfile, fi); err != nil {
+			return "", trace.Wrap(err)
+		}
+	}
+
+	fmt.Fprintf(h, "target %q\n", m.Target)
+	for _, key := range sortedKeys(m.BuildArgs) {
+		fmt.Fprintf(h, "arg %q=%q\n", key, m.BuildArgs[key])
+	}
+	for _, key := range sortedKeys(m.Labels) {
+		if key != DockerContextDigestLabel {
+			fmt.Fprintf(h, "label %q=%q\n", key, m.Labels[key])
+		}
+	}
+	for _, platform := range m.Platforms {
+		fmt.Fprintf(h, "platform %q\n", platform)
+	}
+	return digester.Digest(), nil
+}
+
+// hashContextFile writes the contents of the regular file or the target of the symlink at path to w
+func hashContextFile(w io.Writer, path string, fi os.FileInfo) error {
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(path)
+		if err != nil {
+			return trace.ConvertSystemError(err)
+		}
+		fmt.Fprintf(w, "link %q\n", link)
+	case fi.Mode().IsRegular():
+		f, err := os.Open(path)
+		if err != nil {
+			return trace.ConvertSystemError(err)
+		}
+		defer f.Close()
+		fmt.Fprintf(w, "size %v\n", fi.Size())
+		if _, err := io.Copy(w, f); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// findUnchanged returns the result of the previous build if all tagged images
+// exist locally and have been built from the context with the specified digest.
+// Returns nil if the image needs to be built
+func (m *DockerConfigBuild) findUnchanged(ctx context.Context, contextDigest digest.Digest) (*DockerBuildResult, error) {
+	var imageID string
+	for _, tag := range m.Tag {
+		image, err := m.inspectImage(ctx, tag)
+		if err != nil {
+			if trace.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, trace.Wrap(err)
+		}
+		if image.Labels[DockerContextDigestLabel] != contextDigest.String() {
+			return nil, nil
+		}
+		if imageID != "" && imageID != image.ID {
+			return nil, nil
+		}
+		imageID = image.ID
+	}
+	return &DockerBuildResult{
+		ImageID:       imageID,
+		ContextDigest: contextDigest,
+		Cached:        true,
+	}, nil
+}
+
+// inspectImage returns the local image with the given name using the configured backend
+func (m *DockerConfigBuild) inspectImage(ctx context.Context, image string) (*DockerImage, error) {
+	if m.backend() == DockerBackendAPI {
+		client, err := m.target.root.DockerClient()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		result, err := client.ImageInspect(ctx, image)
+		return result, trace.Wrap(err)
+	}
+
+	// inspect the image on the same daemon the build runs against
+	var buf bytes.Buffer
+	_, err := run(ctx, m.Env, nil, &buf, &buf, "", "docker", "image", "inspect", image)
+	out := buf.String()
+	if err != nil {
+		if strings.Contains(out, "No such image") {
+			return nil, trace.NotFound("no such image: %v", image)
+		}
+		return nil, trace.Wrap(err, "failed to inspect image %v: %v", image, out)
+	}
+	var result []dockerImageJSON
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if len(result) == 0 {
+		return nil, trace.NotFound("no such image: %v", image)
+	}
+	return result[0].image(), nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
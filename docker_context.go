@@ -0,0 +1,206 @@
+package magnet
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gravitational/magnet/pkg/cp"
+	"github.com/gravitational/trace"
+)
+
+// dockerContextFile describes a file in the build context
+type dockerContextFile struct {
+	// name specifies the slash-separated path of the file in the context
+	name string
+	// path specifies the path of the source file
+	path string
+	fi   os.FileInfo
+}
+
+// dockerContext describes the files sent to the daemon as the build context
+type dockerContext struct {
+	// dir specifies the context directory. Empty for custom contexts
+	// assembled from copy operations, which only exist as a tar stream
+	dir string
+	// files lists the files included in the context
+	files []dockerContextFile
+}
+
+// ContextFiles returns the paths of the files included in the build context
+// after applying the copy operations and the .dockerignore patterns.
+// Useful for debugging the contents of the context
+func (m *DockerConfigBuild) ContextFiles(contextPath string) ([]string, error) {
+	buildContext, _, err := m.buildContext(contextPath)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	names := make([]string, 0, len(buildContext.files))
+	for _, f := range buildContext.files {
+		names = append(names, f.name)
+	}
+	return names, nil
+}
+
+// buildContext determines the files of the build context.
+// If copy operations have been configured, the context is assembled from the copied files
+// and the Dockerfile is placed at the root of the context.
+// Returns the context and the Dockerfile to use
+func (m *DockerConfigBuild) buildContext(contextPath string) (buildContext *dockerContext, dockerfile string, err error) {
+	contextPath, err = filepath.Abs(contextPath)
+	if err != nil {
+		return nil, "", trace.Wrap(err)
+	}
+	dockerfile = m.dockerfilePath(contextPath)
+	if len(m.ContextCopyConfigs) == 0 {
+		buildContext, err = readDockerContext(contextPath, dockerfile)
+		return buildContext, dockerfile, trace.Wrap(err)
+	}
+
+	files := make(map[string]dockerContextFile)
+	for _, c := range m.ContextCopyConfigs {
+		// copy operations are relative to the root of the context
+		dst := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(c.Destination)), "/")
+		err := cp.Walk(c, func(src, rel string, fi os.FileInfo) error {
+			name := path.Join(dst, filepath.ToSlash(rel))
+			if name != "" {
+				files[name] = dockerContextFile{name: name, path: src, fi: fi}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+	}
+
+	source := filepath.Join(contextPath, "Dockerfile")
+	if dockerfile != "" {
+		source = dockerfile
+	}
+	fi, err := os.Stat(source)
+	if err != nil {
+		return nil, "", trace.ConvertSystemError(err)
+	}
+	files["Dockerfile"] = dockerContextFile{name: "Dockerfile", path: source, fi: fi}
+
+	// the .dockerignore copied to the context takes precedence over the one in the context directory
+	ignorePath := filepath.Join(contextPath, DockerIgnoreFile)
+	if f, ok := files[DockerIgnoreFile]; ok {
+		ignorePath = f.path
+	}
+	ignore, err := readDockerIgnore(ignorePath)
+	if err != nil {
+		return nil, "", trace.Wrap(err)
+	}
+
+	buildContext = &dockerContext{}
+	for _, f := range files {
+		if f.name != "Dockerfile" && f.name != DockerIgnoreFile && ignore.excluded(f.name) {
+			continue
+		}
+		buildContext.files = append(buildContext.files, f)
+	}
+	sort.Slice(buildContext.files, func(i, j int) bool {
+		return buildContext.files[i].name < buildContext.files[j].name
+	})
+	return buildContext, "", nil
+}
+
+// dockerfilePath returns the absolute path to the configured Dockerfile.
+// A relative path is resolved against the context directory contextPath (as with
+// the Docker Engine API), so all backends use the same file.
+// Returns an empty path if no Dockerfile has been configured
+func (m *DockerConfigBuild) dockerfilePath(contextPath string) string {
+	if m.Dockerfile == "" || filepath.IsAbs(m.Dockerfile) {
+		return m.Dockerfile
+	}
+	return filepath.Join(contextPath, m.Dockerfile)
+}
+
+// contextName returns the slash-separated name of the file at path relative to
+// the context directory dir. Returns false if the file is outside of the context
+func contextName(dir, path string) (string, bool) {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// readDockerContext returns the files in the context directory dir that are not excluded by
+// the .dockerignore file. As with the docker CLI, the Dockerfile and the .dockerignore file
+// are always included. dockerfile is either empty or an absolute path
+func readDockerContext(dir, dockerfile string) (*dockerContext, error) {
+	ignore, err := readDockerIgnore(filepath.Join(dir, DockerIgnoreFile))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	keep := map[string]bool{DockerIgnoreFile: true, "Dockerfile": true}
+	if dockerfile != "" {
+		if name, ok := contextName(dir, dockerfile); ok {
+			keep[name] = true
+		}
+	}
+
+	buildContext := &dockerContext{dir: dir}
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return trace.ConvertSystemError(err)
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return trace.Wrap(err)
+		}
+		name := filepath.ToSlash(rel)
+		if !keep[name] && ignore.excluded(name) {
+			// the contents of an excluded directory can only be included with an exception
+			if fi.IsDir() && !ignore.exceptions {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		delete(keep, name)
+		buildContext.files = append(buildContext.files, dockerContextFile{name: name, path: path, fi: fi})
+		return nil
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// files to keep are not reached by the walk if they are inside an excluded directory
+	var added bool
+	for name := range keep {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		fi, err := os.Lstat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, trace.ConvertSystemError(err)
+		}
+		buildContext.files = append(buildContext.files, dockerContextFile{name: name, path: path, fi: fi})
+		added = true
+	}
+	if added {
+		sort.Slice(buildContext.files, func(i, j int) bool {
+			return buildContext.files[i].name < buildContext.files[j].name
+		})
+	}
+	return buildContext, nil
+}
+
+// writeTar writes the files of the context to w as a tar archive
+func (r *dockerContext) writeTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, f := range r.files {
+		if err := writeTarEntry(tw, f.path, f.name, f.fi); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return trace.Wrap(tw.Close())
+}
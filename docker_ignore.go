@@ -0,0 +1,147 @@
+package magnet
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gravitational/trace"
+)
+
+// DockerIgnoreFile names the file with the exclusion patterns of the build context
+const DockerIgnoreFile = ".dockerignore"
+
+// dockerIgnore matches paths in the build context against the patterns of a .dockerignore file.
+// Patterns follow the semantics of the docker CLI: * and ? match within a single path element,
+// ** matches any number of elements, a pattern matching a directory excludes its contents and
+// patterns starting with ! re-include paths excluded by the previous patterns
+type dockerIgnore struct {
+	patterns []dockerIgnorePattern
+	// exceptions specifies whether any of the patterns is a negation
+	exceptions bool
+}
+
+type dockerIgnorePattern struct {
+	negate bool
+	re     *regexp.Regexp
+}
+
+// readDockerIgnore reads the patterns from the file at path.
+// Returns an empty matcher if the file does not exist
+func readDockerIgnore(path string) (*dockerIgnore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &dockerIgnore{}, nil
+		}
+		return nil, trace.ConvertSystemError(err)
+	}
+	defer f.Close()
+	ignore, err := parseDockerIgnore(f)
+	return ignore, trace.Wrap(err, "invalid %v", path)
+}
+
+func parseDockerIgnore(r io.Reader) (*dockerIgnore, error) {
+	ignore := &dockerIgnore{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var negate bool
+		if strings.HasPrefix(line, "!") {
+			negate = true
+			line = strings.TrimSpace(line[1:])
+		}
+		line = strings.TrimPrefix(path.Clean(filepath.ToSlash(line)), "/")
+		if line == "" || line == "." {
+			continue
+		}
+		re, err := compileDockerIgnorePattern(line)
+		if err != nil {
+			return nil, trace.BadParameter("invalid pattern %q: %v", line, err)
+		}
+		ignore.patterns = append(ignore.patterns, dockerIgnorePattern{
+			negate: negate,
+			re:     re,
+		})
+		ignore.exceptions = ignore.exceptions || negate
+	}
+	return ignore, trace.Wrap(scanner.Err())
+}
+
+// compileDockerIgnorePattern converts the pattern to an anchored regular expression
+func compileDockerIgnorePattern(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch ch := runes[i]; ch {
+		case '*':
+			if i+1 < len(runes) && runes[i+1] == '*' {
+				i++
+				switch {
+				case i+1 == len(runes):
+					b.WriteString(".*")
+				case runes[i+1] == '/':
+					i++
+					b.WriteString("(.*/)?")
+				default:
+					b.WriteString(".*")
+				}
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			// character classes are passed through, with ! as the negation
+			end := strings.IndexRune(string(runes[i+1:]), ']')
+			if end < 0 {
+				return nil, trace.BadParameter("unterminated character class")
+			}
+			class := []rune(string(runes[i+1:])[:end])
+			if len(class) != 0 && class[0] == '!' {
+				class[0] = '^'
+			}
+			b.WriteString("[" + string(class) + "]")
+			i += len(class) + 1
+		case '\\':
+			if i+1 < len(runes) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(runes[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	return re, trace.Wrap(err)
+}
+
+// excluded returns true if the slash-separated path in the context is excluded
+func (r *dockerIgnore) excluded(name string) bool {
+	elements := strings.Split(name, "/")
+	var excluded bool
+	for _, pattern := range r.patterns {
+		// only patterns that can change the result need to be evaluated
+		if pattern.negate != excluded {
+			continue
+		}
+		match := pattern.re.MatchString(name)
+		// a pattern matching any of the parent directories also matches its contents
+		for i := 1; !match && i < len(elements); i++ {
+			match = pattern.re.MatchString(strings.Join(elements[:i], "/"))
+		}
+		if match {
+			excluded = !pattern.negate
+		}
+	}
+	return excluded
+}
@@ -0,0 +1,314 @@
+package magnet
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gravitational/magnet/pkg/progressui"
+	"github.com/gravitational/trace"
+	"github.com/opencontainers/go-digest"
+)
+
+// DockerPull pulls the image from the registry and returns the digest of the image manifest.
+// The progress of each layer is reported as the status of the target.
+// Registry credentials are read from the docker CLI configuration file
+func (m *MagnetTarget) DockerPull(ctx context.Context, image string) (digest.Digest, error) {
+	client, err := m.root.DockerClient()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	auth, err := dockerRegistryAuth(image)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	m.Printlnf("Pulling %v", image)
+	progress := newDockerProgressWriter(m)
+	d, err := client.imagePull(ctx, image, auth, progress.update)
+	return d, trace.Wrap(err)
+}
+
+// DockerPush pushes the image to the registry and returns the digest of the image manifest.
+// The progress of each layer is reported as the status of the target.
+// Registry credentials are read from the docker CLI configuration file
+func (m *MagnetTarget) DockerPush(ctx context.Context, image string) (digest.Digest, error) {
+	client, err := m.root.DockerClient()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	auth, err := dockerRegistryAuth(image)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	m.Printlnf("Pushing %v", image)
+	progress := newDockerProgressWriter(m)
+	d, err := client.imagePush(ctx, image, auth, progress.update)
+	return d, trace.Wrap(err)
+}
+
+// DockerTag creates the tag target referring to the source image
+func (m *MagnetTarget) DockerTag(ctx context.Context, source, target string) error {
+	client, err := m.root.DockerClient()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	m.Printlnf("Tagging %v as %v", source, target)
+	return trace.Wrap(client.imageTag(ctx, source, target))
+}
+
+// DockerSave saves the images to the tarball at path and returns the digest of the tarball
+func (m *MagnetTarget) DockerSave(ctx context.Context, path string, images ...string) (digest.Digest, error) {
+	client, err := m.root.DockerClient()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	m.Printlnf("Saving %v to %v", strings.Join(images, " "), path)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", trace.ConvertSystemError(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return "", trace.ConvertSystemError(err)
+	}
+	defer f.Close()
+
+	progress := &dlProgressWriter{m: m, url: path}
+	progress.Init()
+	hash := sha256.New()
+	if err := client.imageSave(ctx, images, io.MultiWriter(f, hash, progress)); err != nil {
+		_ = os.Remove(path)
+		return "", trace.Wrap(err)
+	}
+	progress.Complete()
+	if err := f.Close(); err != nil {
+		return "", trace.ConvertSystemError(err)
+	}
+	return digest.NewDigest(digest.SHA256, hash), nil
+}
+
+// DockerLoad loads the images from the tarball at path and returns the names
+// (or IDs, for untagged images) of the loaded images
+func (m *MagnetTarget) DockerLoad(ctx context.Context, path string) (images []string, err error) {
+	client, err := m.root.DockerClient()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	m.Printlnf("Loading %v", path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+
+	progress := &dlProgressWriter{m: m, url: path, total: fi.Size()}
+	progress.Init()
+	stdout, _ := outStreams(m.vertex.Digest, m.root.status)
+	images, err = client.imageLoad(ctx, io.TeeReader(f, progress), stdout)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	progress.Complete()
+	return images, nil
+}
+
+// DockerRemove removes the image from the local image store.
+// If force is set, the image is removed even if it's in use by stopped containers or has multiple tags
+func (m *MagnetTarget) DockerRemove(ctx context.Context, image string, force bool) error {
+	client, err := m.root.DockerClient()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	m.Printlnf("Removing %v", image)
+	return trace.Wrap(client.imageRemove(ctx, image, force))
+}
+
+// imagePull pulls the image and returns the manifest digest.
+// fn is invoked for each progress message
+func (c *DockerClient) imagePull(ctx context.Context, image, auth string, fn func(jsonMessage)) (d digest.Digest, err error) {
+	repo, tag := splitImageReference(image)
+	query := url.Values{"fromImage": {repo}, "tag": {tag}}
+	resp, err := c.do(ctx, http.MethodPost, "/images/create", query, nil, http.Header{"X-Registry-Auth": {auth}})
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+
+	err = decodeJSONMessages(resp.Body, func(msg jsonMessage) error {
+		if strings.HasPrefix(msg.Status, "Digest: ") {
+			d = digest.Digest(strings.TrimPrefix(msg.Status, "Digest: "))
+		}
+		fn(msg)
+		return nil
+	})
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	if d == "" && strings.Contains(tag, ":") {
+		// pulled by digest
+		d = digest.Digest(tag)
+	}
+	return d, nil
+}
+
+// imagePush pushes the image and returns the manifest digest.
+// fn is invoked for each progress message
+func (c *DockerClient) imagePush(ctx context.Context, image, auth string, fn func(jsonMessage)) (d digest.Digest, err error) {
+	repo, tag := splitImageReference(image)
+	query := url.Values{"tag": {tag}}
+	resp, err := c.do(ctx, http.MethodPost, "/images/"+repo+"/push", query, nil, http.Header{"X-Registry-Auth": {auth}})
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+
+	err = decodeJSONMessages(resp.Body, func(msg jsonMessage) error {
+		var aux struct {
+			Digest string
+		}
+		if len(msg.Aux) != 0 && json.Unmarshal(msg.Aux, &aux) == nil && aux.Digest != "" {
+			d = digest.Digest(aux.Digest)
+		}
+		fn(msg)
+		return nil
+	})
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	if d == "" {
+		return "", trace.BadParameter("docker push did not return a digest")
+	}
+	return d, nil
+}
+
+func (c *DockerClient) imageTag(ctx context.Context, source, target string) error {
+	repo, tag := splitImageReference(target)
+	query := url.Values{"repo": {repo}, "tag": {tag}}
+	return trace.Wrap(c.postJSON(ctx, "/images/"+source+"/tag", query, nil, nil))
+}
+
+// imageSave writes the tarball with the images to w
+func (c *DockerClient) imageSave(ctx context.Context, images []string, w io.Writer) error {
+	resp, err := c.do(ctx, http.MethodGet, "/images/get", url.Values{"names": images}, nil, nil)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return trace.Wrap(err)
+}
+
+// imageLoad loads the images from the tarball read from r and returns the loaded images.
+// The output of the daemon is written to w
+func (c *DockerClient) imageLoad(ctx context.Context, r io.Reader, w io.Writer) (images []string, err error) {
+	header := http.Header{"Content-Type": {"application/x-tar"}}
+	resp, err := c.do(ctx, http.MethodPost, "/images/load", url.Values{"quiet": {"1"}}, r, header)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+
+	err = decodeJSONMessages(resp.Body, func(msg jsonMessage) error {
+		_, _ = io.WriteString(w, msg.Stream)
+		for _, prefix := range []string{"Loaded image: ", "Loaded image ID: "} {
+			if strings.HasPrefix(msg.Stream, prefix) {
+				images = append(images, strings.TrimSpace(strings.TrimPrefix(msg.Stream, prefix)))
+			}
+		}
+		return nil
+	})
+	return images, trace.Wrap(err)
+}
+
+func (c *DockerClient) imageRemove(ctx context.Context, image string, force bool) error {
+	query := url.Values{}
+	if force {
+		query.Set("force", "1")
+	}
+	resp, err := c.do(ctx, http.MethodDelete, "/images/"+image, query, nil, nil)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(resp.Body.Close())
+}
+
+// splitImageReference splits the image reference into the repository and the tag or digest.
+// The tag defaults to latest
+func splitImageReference(image string) (repo, tag string) {
+	if i := strings.IndexRune(image, '@'); i >= 0 {
+		return image[:i], image[i+1:]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, "latest"
+}
+
+// dockerProgressWriter reports the progress of individual layers in the
+// JSON message stream of the pull and push APIs as statuses of the target.
+// Messages without progress are written to the target's log
+type dockerProgressWriter struct {
+	m *MagnetTarget
+	// layers maps layer IDs to the last reported status
+	layers map[string]*progressui.VertexStatus
+}
+
+func newDockerProgressWriter(m *MagnetTarget) *dockerProgressWriter {
+	return &dockerProgressWriter{
+		m:      m,
+		layers: make(map[string]*progressui.VertexStatus),
+	}
+}
+
+func (d *dockerProgressWriter) update(msg jsonMessage) {
+	if msg.Progress == "" && msg.Status != "" {
+		if msg.ID != "" {
+			d.m.Printlnf("%v: %v", msg.ID, msg.Status)
+		} else {
+			d.m.Println(msg.Status)
+		}
+	}
+	if msg.ID == "" || strings.HasPrefix(msg.Status, "Pulling from") || strings.HasPrefix(msg.Status, "The push refers to") {
+		return
+	}
+
+	now := time.Now()
+	status, ok := d.layers[msg.ID]
+	if !ok {
+		status = &progressui.VertexStatus{
+			ID:      msg.ID,
+			Vertex:  d.m.vertex.Digest,
+			Started: &now,
+		}
+		d.layers[msg.ID] = status
+	}
+	status.Name = msg.Status
+	status.Timestamp = now
+	if msg.ProgressDetail.Total > 0 {
+		status.Current, status.Total = msg.ProgressDetail.Current, msg.ProgressDetail.Total
+	}
+	switch {
+	case msg.Status == "Pull complete", msg.Status == "Already exists",
+		msg.Status == "Pushed", msg.Status == "Layer already exists",
+		strings.HasPrefix(msg.Status, "Mounted from"):
+		status.Current = status.Total
+		status.Completed = &now
+	}
+
+	update := *status
+	d.m.root.status <- &progressui.SolveStatus{
+		Statuses: []*progressui.VertexStatus{&update},
+	}
+}
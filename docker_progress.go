@@ -0,0 +1,101 @@
+package magnet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/gravitational/magnet/pkg/progressui"
+	"github.com/opencontainers/go-digest"
+)
+
+// buildkitProgressWriter decodes the BuildKit progress stream in the rawjson format
+// (one JSON-encoded SolveStatus per line) and forwards it to the progress output
+// with every build step grafted as a child vertex of the target.
+// Lines that are not valid JSON are written to the target's stderr log
+type buildkitProgressWriter struct {
+	target *MagnetTarget
+	buf    []byte
+}
+
+func newBuildkitProgressWriter(target *MagnetTarget) *buildkitProgressWriter {
+	return &buildkitProgressWriter{target: target}
+}
+
+// Write implements io.Writer
+func (w *buildkitProgressWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.handleLine(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close flushes the remaining incomplete line
+func (w *buildkitProgressWriter) Close() error {
+	if len(w.buf) != 0 {
+		w.handleLine(w.buf)
+		w.buf = nil
+	}
+	return nil
+}
+
+func (w *buildkitProgressWriter) handleLine(line []byte) {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return
+	}
+	var status progressui.SolveStatus
+	if line[0] != '{' || json.Unmarshal(line, &status) != nil {
+		_, stderr := outStreams(w.target.vertex.Digest, w.target.root.status)
+		_, _ = stderr.Write(append(append([]byte{}, line...), '\n'))
+		return
+	}
+	w.target.root.status <- w.graft(&status)
+}
+
+// graft rewrites the status so the build steps are displayed as children of the target.
+// Digests are scoped to the target so identical steps of different builds don't clash
+func (w *buildkitProgressWriter) graft(status *progressui.SolveStatus) *progressui.SolveStatus {
+	for _, v := range status.Vertexes {
+		v.Digest = w.scope(v.Digest)
+		v.Inputs = []digest.Digest{w.target.vertex.Digest}
+	}
+	for _, s := range status.Statuses {
+		s.Vertex = w.scope(s.Vertex)
+	}
+	for _, l := range status.Logs {
+		l.Vertex = w.scope(l.Vertex)
+	}
+	return status
+}
+
+func (w *buildkitProgressWriter) scope(d digest.Digest) digest.Digest {
+	return digest.FromString(w.target.vertex.Digest.String() + d.String())
+}
+
+// supportsRawProgress returns whether the docker CLI supports the rawjson progress format
+// for the build command given with args (build or buildx build).
+// Older versions of the CLI fail the build with an unknown progress type, so the support
+// is determined from the help output of the command once per command
+func (m *Magnet) supportsRawProgress(ctx context.Context, env map[string]string, args ...string) bool {
+	key := strings.Join(args, " ")
+	m.rawProgressMu.Lock()
+	defer m.rawProgressMu.Unlock()
+	if supported, ok := m.rawProgress[key]; ok {
+		return supported
+	}
+	var stdout bytes.Buffer
+	_, err := run(ctx, env, nil, &stdout, &stdout, "", "docker", append(args, "--help")...)
+	supported := err == nil && strings.Contains(stdout.String(), "rawjson")
+	if m.rawProgress == nil {
+		m.rawProgress = make(map[string]bool)
+	}
+	m.rawProgress[key] = supported
+	return supported
+}
@@ -0,0 +1,125 @@
+package magnet
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/gravitational/trace"
+)
+
+// DockerBuildSecret describes a secret exposed to the build with RUN --mount=type=secret.
+// Unlike build args, secrets are not recorded in the image history
+type DockerBuildSecret struct {
+	// ID identifies the secret in the Dockerfile
+	ID string
+	// Value specifies the value of the secret.
+	// The value is passed to docker in the environment and never on the command line
+	Value string
+	// File optionally specifies the path to the file with the secret instead of the value
+	File string
+}
+
+// DockerBuildSSH describes an SSH agent socket or a set of keys forwarded to the build
+// with RUN --mount=type=ssh
+type DockerBuildSSH struct {
+	// ID identifies the SSH agent in the Dockerfile (Default: default)
+	ID string
+	// Paths optionally lists the agent sockets or key files.
+	// If unspecified, the agent at $SSH_AUTH_SOCK is forwarded
+	Paths []string
+}
+
+// AddSecret adds a secret with the specified value to the build.
+// The value is registered to be redacted from the log output.
+func (m *DockerConfigBuild) AddSecret(id, value string) *DockerConfigBuild {
+	RegisterSecret(value)
+	m.Secrets = append(m.Secrets, DockerBuildSecret{ID: id, Value: value})
+	return m
+}
+
+// AddSecretEnv adds a secret with the value of the environment variable specified with e to the build.
+// If the variable has already been registered, the existing definition is used,
+// otherwise it is registered as a secret. Either way, the value is redacted from the log output.
+func (m *DockerConfigBuild) AddSecretEnv(id string, e EnvVar) *DockerConfigBuild {
+	value, ok := GetEnv(e.Key)
+	if !ok {
+		e.Secret = true
+		value = E(e)
+	}
+	return m.AddSecret(id, value)
+}
+
+// AddSecretFile adds a secret read from the file at path to the build.
+// The contents of the file are read and registered to be redacted from the log output
+// when the build runs
+func (m *DockerConfigBuild) AddSecretFile(id, path string) *DockerConfigBuild {
+	m.Secrets = append(m.Secrets, DockerBuildSecret{ID: id, File: path})
+	return m
+}
+
+// AddSSH forwards the SSH agent socket or keys given with paths to the build.
+// If no paths are given, the agent at $SSH_AUTH_SOCK is forwarded.
+func (m *DockerConfigBuild) AddSSH(id string, paths ...string) *DockerConfigBuild {
+	m.SSH = append(m.SSH, DockerBuildSSH{ID: id, Paths: paths})
+	return m
+}
+
+// secretArgs returns the --secret and --ssh flags along with the environment
+// the secret values are passed in
+func (m *DockerConfigBuild) secretArgs() (args []string, env map[string]string, err error) {
+	env = make(map[string]string)
+	for _, secret := range m.Secrets {
+		if secret.ID == "" {
+			return nil, nil, trace.BadParameter("build secret requires an ID")
+		}
+		if secret.File != "" {
+			if err := registerSecretFile(secret.File); err != nil {
+				return nil, nil, trace.Wrap(err)
+			}
+			args = append(args, "--secret", fmt.Sprintf("id=%v,src=%v", secret.ID, secret.File))
+			continue
+		}
+		key := secretEnvKey(secret.ID)
+		if _, ok := env[key]; ok {
+			return nil, nil, trace.BadParameter("duplicate build secret %q", secret.ID)
+		}
+		env[key] = secret.Value
+		args = append(args, "--secret", fmt.Sprintf("id=%v,env=%v", secret.ID, key))
+	}
+	for _, ssh := range m.SSH {
+		id := ssh.ID
+		if id == "" {
+			id = "default"
+		}
+		if len(ssh.Paths) != 0 {
+			id = fmt.Sprintf("%v=%v", id, strings.Join(ssh.Paths, ","))
+		}
+		args = append(args, "--ssh", id)
+	}
+	return args, env, nil
+}
+
+// registerSecretFile registers the contents of the secret file at path
+// to be redacted from the log output.
+// The contents are registered as a whole: individual lines of a multi-line
+// file (e.g. credentials) are not redacted when logged separately
+func registerSecretFile(path string) error {
+	value, err := readSecretFile(path)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	RegisterSecret(value)
+	return nil
+}
+
+// secretEnvKey returns the name of the environment variable
+// the value of the secret with the specified ID is passed in
+func secretEnvKey(id string) string {
+	return "MAGNET_BUILD_SECRET_" + strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return '_'
+		}
+		return unicode.ToUpper(r)
+	}, id)
+}
@@ -0,0 +1,699 @@
+package magnet
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gravitational/magnet/pkg/progressui"
+	"github.com/gravitational/trace"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDocker implements a subset of the Docker Engine API for tests
+type fakeDocker struct {
+	mu sync.Mutex
+	// contexts records the files in the build contexts sent to the daemon
+	contexts [][]string
+	// containers records the configurations of created containers
+	containers []dockerContainerConfig
+	// removed lists the IDs of removed containers
+	removed []string
+	// exitCode specifies the exit code of the containers
+	exitCode int
+	// images records the image operations
+	images []string
+	// auth records the registry credentials sent with the push requests
+	auth []dockerAuthConfig
+	// labels maps the tags of built images to their labels
+	labels map[string]map[string]string
+}
+
+func (r *fakeDocker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	path := strings.TrimPrefix(req.URL.Path, "/"+dockerAPIVersion)
+	switch {
+	case path == "/_ping":
+		fmt.Fprint(w, "OK")
+	case path == "/build":
+		var files []string
+		tr := tar.NewReader(req.Body)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			files = append(files, hdr.Name)
+		}
+		r.contexts = append(r.contexts, files)
+		var labels map[string]string
+		json.Unmarshal([]byte(req.URL.Query().Get("labels")), &labels)
+		for _, tag := range req.URL.Query()["t"] {
+			if r.labels == nil {
+				r.labels = make(map[string]map[string]string)
+			}
+			r.labels[tag] = labels
+		}
+		enc := json.NewEncoder(w)
+		enc.Encode(map[string]string{"stream": "Step 1/1 : FROM scratch\n"})
+		enc.Encode(map[string]interface{}{"aux": map[string]string{"ID": "sha256:built"}})
+	case req.Method == http.MethodGet && strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/json"):
+		labels, ok := r.labels[strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/json")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": "no such image"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Id": "sha256:built", "Config": map[string]interface{}{"Labels": labels}})
+	case path == "/images/create":
+		r.images = append(r.images, "pull "+req.URL.Query().Get("fromImage")+":"+req.URL.Query().Get("tag"))
+		enc := json.NewEncoder(w)
+		enc.Encode(map[string]string{"status": "Pulling from library/alpine", "id": "3.12"})
+		enc.Encode(map[string]interface{}{"status": "Downloading", "id": "layer1", "progress": "[=>  ]",
+			"progressDetail": map[string]int{"current": 10, "total": 20}})
+		enc.Encode(map[string]string{"status": "Pull complete", "id": "layer1"})
+		enc.Encode(map[string]string{"status": "Digest: sha256:pulled"})
+	case strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/push"):
+		var auth dockerAuthConfig
+		buf, _ := base64.URLEncoding.DecodeString(req.Header.Get("X-Registry-Auth"))
+		json.Unmarshal(buf, &auth)
+		r.auth = append(r.auth, auth)
+		r.images = append(r.images, "push "+strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/push")+":"+req.URL.Query().Get("tag"))
+		enc := json.NewEncoder(w)
+		enc.Encode(map[string]string{"status": "Pushed", "id": "layer1"})
+		enc.Encode(map[string]interface{}{"aux": map[string]string{"Tag": "1.0", "Digest": "sha256:pushed"}})
+	case strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/tag"):
+		r.images = append(r.images, "tag "+strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/tag")+" "+
+			req.URL.Query().Get("repo")+":"+req.URL.Query().Get("tag"))
+		w.WriteHeader(http.StatusCreated)
+	case path == "/images/get":
+		r.images = append(r.images, "save "+strings.Join(req.URL.Query()["names"], ","))
+		fmt.Fprint(w, "tarball")
+	case path == "/images/load":
+		buf, _ := ioutil.ReadAll(req.Body)
+		r.images = append(r.images, "load "+string(buf))
+		json.NewEncoder(w).Encode(map[string]string{"stream": "Loaded image: app:1.0\n"})
+	case req.Method == http.MethodDelete && strings.HasPrefix(path, "/images/"):
+		r.images = append(r.images, "remove "+strings.TrimPrefix(path, "/images/"))
+		json.NewEncoder(w).Encode([]map[string]string{{"Untagged": "app:1.0"}})
+	case path == "/containers/create":
+		var config dockerContainerConfig
+		json.NewDecoder(req.Body).Decode(&config)
+		var pulled bool
+		for _, op := range r.images {
+			pulled = pulled || op == "pull "+config.Image
+		}
+		if strings.HasPrefix(config.Image, "remote/") && !pulled {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": "No such image: " + config.Image})
+			return
+		}
+		r.containers = append(r.containers, config)
+		json.NewEncoder(w).Encode(map[string]string{"Id": fmt.Sprint("container", len(r.containers))})
+	case strings.HasSuffix(path, "/start"):
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(path, "/logs"):
+		for stream, data := range map[byte]string{1: "out\n", 2: "err\n"} {
+			header := make([]byte, 8)
+			header[0] = stream
+			binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+			w.Write(append(header, data...))
+		}
+	case strings.HasSuffix(path, "/wait"):
+		json.NewEncoder(w).Encode(map[string]int{"StatusCode": r.exitCode})
+	case req.Method == http.MethodDelete && strings.HasPrefix(path, "/containers/"):
+		r.removed = append(r.removed, strings.TrimPrefix(path, "/containers/"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "no such object: " + path})
+	}
+}
+
+// newFakeDocker starts the fake Docker Engine API on a unix socket.
+// Returns the docker host address
+func newFakeDocker(t *testing.T, docker *fakeDocker) (host string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "magnet-docker")
+	require.NoError(t, err)
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	srv := &http.Server{Handler: docker}
+	go srv.Serve(listener)
+	return "unix://" + socket, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDockerAPIBackend(t *testing.T) {
+	docker := &fakeDocker{}
+	host, stop := newFakeDocker(t, docker)
+	defer stop()
+
+	target, cleanup := newTestTarget(t, Config{DockerHost: host, DockerBackend: DockerBackendAPI})
+	defer cleanup()
+
+	client, err := target.root.DockerClient()
+	require.NoError(t, err)
+	require.NoError(t, client.Ping(context.TODO()))
+
+	dir, err := ioutil.TempDir("", "magnet-context")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM scratch\n"), 0644))
+
+	build, err := target.DockerBuild().AddTag("image:latest").SetSkipUnchanged(true).BuildImage(context.TODO(), dir)
+	require.NoError(t, err)
+	require.Equal(t, "sha256:built", build.ImageID)
+	require.False(t, build.Cached)
+	require.Equal(t, [][]string{{"Dockerfile"}}, docker.contexts)
+	require.Equal(t, build.ContextDigest.String(), docker.labels["image:latest"][DockerContextDigestLabel])
+
+	// unchanged context and parameters skip the build
+	cached, err := target.DockerBuild().AddTag("image:latest").SetSkipUnchanged(true).BuildImage(context.TODO(), dir)
+	require.NoError(t, err)
+	require.Equal(t, &DockerBuildResult{ImageID: "sha256:built", ContextDigest: build.ContextDigest, Cached: true}, cached)
+	require.Len(t, docker.contexts, 1)
+
+	// skipping is opt-in
+	_, err = target.DockerBuild().AddTag("image:latest").BuildImage(context.TODO(), dir)
+	require.NoError(t, err)
+	require.Len(t, docker.contexts, 2)
+
+	// changed build args trigger a rebuild
+	rebuild, err := target.DockerBuild().AddTag("image:latest").SetSkipUnchanged(true).SetBuildArg("VERSION", "2").BuildImage(context.TODO(), dir)
+	require.NoError(t, err)
+	require.False(t, rebuild.Cached)
+	require.NotEqual(t, build.ContextDigest, rebuild.ContextDigest)
+	require.Len(t, docker.contexts, 3)
+
+	run, err := target.DockerRun().
+		SetEnv("KEY", "value").
+		SetRemove(true).
+		AddVolume(DockerBindMount{Source: "/src", Destination: "/dst", Readonly: true}).
+		RunContainer(context.TODO(), "image:latest", "echo", "hello")
+	require.NoError(t, err)
+	require.Equal(t, &DockerRunResult{ContainerID: "container1"}, run)
+	require.Equal(t, []string{"echo", "hello"}, docker.containers[0].Cmd)
+	require.Equal(t, []string{"KEY=value"}, docker.containers[0].Env)
+	require.Equal(t, []dockerMount{{Type: "bind", Source: "/src", Target: "/dst", ReadOnly: true}}, docker.containers[0].HostConfig.Mounts)
+	require.Equal(t, []string{"container1"}, docker.removed)
+
+	docker.exitCode = 3
+	run, err = target.DockerRun().RunContainer(context.TODO(), "image:latest", "false")
+	require.Error(t, err)
+	require.Equal(t, 3, run.ExitCode)
+
+	// detached containers are removed by the daemon
+	_, err = target.DockerRun().SetRemove(true).SetDetach(true).RunContainer(context.TODO(), "image:latest", "sleep")
+	require.NoError(t, err)
+	require.True(t, docker.containers[2].HostConfig.AutoRemove)
+	require.Equal(t, []string{"container1"}, docker.removed)
+
+	// missing images are pulled before the container is created
+	docker.exitCode = 0
+	_, err = target.DockerRun().RunContainer(context.TODO(), "remote/app:1.0", "true")
+	require.NoError(t, err)
+	require.Contains(t, docker.images, "pull remote/app:1.0")
+	require.Equal(t, "remote/app:1.0", docker.containers[len(docker.containers)-1].Image)
+
+	_, err = client.ImageInspect(context.TODO(), "missing")
+	require.Error(t, err)
+	require.True(t, trace.IsNotFound(err))
+
+	// image names are escaped in the request path
+	docker.labels["registry:5000/odd?name#1"] = map[string]string{}
+	_, err = client.ImageInspect(context.TODO(), "registry:5000/odd?name#1")
+	require.NoError(t, err)
+
+	// TCP addresses use TLS if configured
+	tlsClient, err := NewDockerClient("tcp://localhost:2376", &DockerTLSConfig{})
+	require.NoError(t, err)
+	require.Equal(t, "https://localhost:2376", tlsClient.base)
+	_, err = NewDockerClient("tcp://localhost:2376", &DockerTLSConfig{CertPath: dir, Verify: true})
+	require.Error(t, err)
+
+	// as with the docker CLI, TLS is only enabled by DOCKER_TLS_VERIFY
+	require.Nil(t, dockerTLSFromEnv(dir, ""))
+	require.Equal(t, &DockerTLSConfig{CertPath: dir, Verify: true}, dockerTLSFromEnv(dir, "1"))
+}
+
+func TestDockerfileRelativeToContext(t *testing.T) {
+	dir, cleanupCLI := newFakeDockerCLI(t, fakeDockerIIDFile)
+	defer cleanupCLI()
+
+	src, err := ioutil.TempDir("", "magnet-context")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "build"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "build", "Dockerfile"), []byte("FROM scratch\n"), 0644))
+
+	target, cleanup := newTestTarget(t, Config{})
+	defer cleanup()
+
+	_, err = target.DockerBuild().SetRawProgress(false).SetDockerfile("build/Dockerfile").BuildImage(context.TODO(), src)
+	require.NoError(t, err)
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.Contains(t, string(args), "-f "+filepath.Join(src, "build", "Dockerfile")+" ")
+}
+
+func TestDockerImages(t *testing.T) {
+	docker := &fakeDocker{}
+	host, stop := newFakeDocker(t, docker)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "magnet-images")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := `{"auths": {"https://registry.example.com": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("user:pa55word")) + `"}}}`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600))
+	dockerConfig := os.Getenv("DOCKER_CONFIG")
+	os.Setenv("DOCKER_CONFIG", dir)
+	defer os.Setenv("DOCKER_CONFIG", dockerConfig)
+
+	target, cleanup := newTestTarget(t, Config{DockerHost: host})
+	defer cleanup()
+	ctx := context.TODO()
+
+	pulled, err := target.DockerPull(ctx, "alpine:3.12")
+	require.NoError(t, err)
+	require.Equal(t, digest.Digest("sha256:pulled"), pulled)
+
+	require.NoError(t, target.DockerTag(ctx, "alpine:3.12", "registry.example.com/app:1.0"))
+
+	pushed, err := target.DockerPush(ctx, "registry.example.com/app:1.0")
+	require.NoError(t, err)
+	require.Equal(t, digest.Digest("sha256:pushed"), pushed)
+	require.Equal(t, []dockerAuthConfig{{Username: "user", Password: "pa55word", ServerAddress: "registry.example.com"}}, docker.auth)
+	require.Contains(t, env.secretValues(), "pa55word")
+
+	path := filepath.Join(dir, "images.tar")
+	saved, err := target.DockerSave(ctx, path, "app:1.0", "alpine:3.12")
+	require.NoError(t, err)
+	require.Equal(t, digest.FromString("tarball"), saved)
+	requireFileContent(t, path, "tarball")
+
+	loaded, err := target.DockerLoad(ctx, path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"app:1.0"}, loaded)
+
+	require.NoError(t, target.DockerRemove(ctx, "app:1.0", true))
+
+	require.Equal(t, []string{
+		"pull alpine:3.12",
+		"tag alpine:3.12 registry.example.com/app:1.0",
+		"push registry.example.com/app:1.0",
+		"save app:1.0,alpine:3.12",
+		"load tarball",
+		"remove app:1.0",
+	}, docker.images)
+}
+
+func TestBuildkitProgressWriter(t *testing.T) {
+	status := make(chan *progressui.SolveStatus, 10)
+	target := &MagnetTarget{
+		root:   &Magnet{status: status},
+		vertex: &progressui.Vertex{Digest: digest.FromString("build")},
+	}
+	w := newBuildkitProgressWriter(target)
+
+	step := digest.FromString("step")
+	_, err := w.Write([]byte(`{"vertexes":[{"digest":"` + step.String() + `","inputs":["sha256:0000000000000000000000000000000000000000000000000000000000000000"],"name":"[1/2] FROM docker.io/library/alpine","cached":true}]}` + "\n" +
+		`{"logs":[{"vertex":"` + step.String() + `","stream":1,"data":"aGVsbG8K"}]}` + "\nERROR: failed"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	vertex := (<-status).Vertexes[0]
+	require.Equal(t, "[1/2] FROM docker.io/library/alpine", vertex.Name)
+	require.True(t, vertex.Cached)
+	require.Equal(t, []digest.Digest{target.vertex.Digest}, vertex.Inputs)
+	require.NotEqual(t, step, vertex.Digest)
+
+	log := (<-status).Logs[0]
+	require.Equal(t, vertex.Digest, log.Vertex)
+	require.Equal(t, "hello\n", string(log.Data))
+
+	log = (<-status).Logs[0]
+	require.Equal(t, target.vertex.Digest, log.Vertex)
+	require.Equal(t, "ERROR: failed\n", string(log.Data))
+}
+
+func TestDockerBuildx(t *testing.T) {
+	dir, cleanupCLI := newFakeDockerCLI(t, `
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--iidfile) echo "sha256:image" > "$2"; shift ;;
+	--metadata-file) echo '{"containerimage.digest":"sha256:manifest","containerimage.config.digest":"sha256:config"}' > "$2"; shift ;;
+	esac
+	shift
+done
+`)
+	defer cleanupCLI()
+
+	target, cleanup := newTestTarget(t, Config{})
+	defer cleanup()
+
+	result, err := target.DockerBuild().
+		SetRawProgress(false).
+		SetBuilder("multiarch").
+		AddPlatform("linux/amd64", "linux/arm64").
+		AddOutput(DockerBuildOutput{Type: DockerOutputOCI, Dest: "/out/image.tar", Attrs: map[string]string{"name": "image"}}).
+		SetPush(true).
+		BuildImage(context.TODO(), dir)
+	require.NoError(t, err)
+	require.Equal(t, "sha256:image", result.ImageID)
+	require.Equal(t, "sha256:manifest", result.Digest)
+	require.Equal(t, "sha256:config", result.ConfigDigest)
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.Contains(t, string(args), "buildx build ")
+	require.Contains(t, string(args), "--builder multiarch --platform linux/amd64,linux/arm64 --output type=oci,dest=/out/image.tar,name=image --push --metadata-file ")
+}
+
+func TestDockerBuildRawProgressFallback(t *testing.T) {
+	dir, cleanupCLI := newFakeDockerCLI(t, `
+case "$*" in
+*--help) echo "--progress string   Set type of progress output (auto, plain, tty)"; exit 0 ;;
+esac
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--iidfile) echo "sha256:image" > "$2"; shift ;;
+	esac
+	shift
+done
+`)
+	defer cleanupCLI()
+
+	target, cleanup := newTestTarget(t, Config{})
+	defer cleanup()
+
+	_, err := target.DockerBuild().SetEnv("DOCKER_BUILDKIT", "1").BuildImage(context.TODO(), dir)
+	require.NoError(t, err)
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.Contains(t, string(args), "--progress=plain")
+	supported, ok := target.root.rawProgress["build"]
+	require.True(t, ok)
+	require.False(t, supported)
+}
+
+func TestDockerBuildSecrets(t *testing.T) {
+	dir, cleanupCLI := newFakeDockerCLI(t, `echo "$MAGNET_BUILD_SECRET_NPM_TOKEN" > "$(dirname "$0")/secret"`+fakeDockerIIDFile)
+	defer cleanupCLI()
+
+	target, cleanup := newTestTarget(t, Config{})
+	defer cleanup()
+
+	credentials := filepath.Join(dir, "credentials")
+	require.NoError(t, ioutil.WriteFile(credentials, []byte("aws-s3cr3t\n"), 0600))
+	os.Setenv("MAGNET_TEST_BUILD_TOKEN", "token-s3cr3t")
+	defer os.Unsetenv("MAGNET_TEST_BUILD_TOKEN")
+	E(EnvVar{Key: "MAGNET_TEST_BUILD_TOKEN", Short: "Build token"})
+
+	_, err := target.DockerBuild().
+		SetRawProgress(false).
+		AddSecret("npm-token", "s3cr3t").
+		AddSecretFile("aws", credentials).
+		AddSecretEnv("token", EnvVar{Key: "MAGNET_TEST_BUILD_TOKEN", Short: "Build token"}).
+		AddSSH("").
+		AddSSH("github", "/keys/id_rsa").
+		SetBuildArg("VERSION", "1.0").
+		BuildImage(context.TODO(), dir)
+	require.NoError(t, err)
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.Contains(t, string(args), "--secret id=npm-token,env=MAGNET_BUILD_SECRET_NPM_TOKEN --secret id=aws,src="+credentials+" --secret id=token,env=MAGNET_BUILD_SECRET_TOKEN --ssh default --ssh github=/keys/id_rsa")
+	require.NotContains(t, string(args), "s3cr3t")
+	requireFileContent(t, filepath.Join(dir, "secret"), "s3cr3t\n")
+	require.Contains(t, env.secretValues(), "s3cr3t")
+	require.Contains(t, env.secretValues(), "aws-s3cr3t")
+	require.Contains(t, env.secretValues(), "token-s3cr3t")
+	// the existing definition is reused instead of being redefined as a secret
+	require.NotContains(t, env.conflicts, "MAGNET_TEST_BUILD_TOKEN")
+
+	_, err = target.DockerBuild().SetBackend(DockerBackendAPI).AddSSH("").BuildImage(context.TODO(), dir)
+	require.True(t, trace.IsNotImplemented(err))
+}
+
+func TestDockerBuildInspectsWithBuildEnv(t *testing.T) {
+	dir, cleanupCLI := newFakeDockerCLI(t, `
+case "$*" in
+image\ inspect*) echo "$DOCKER_HOST" > "$(dirname "$0")/host"; echo "Error: No such image: $3" >&2; exit 1 ;;
+esac
+`+fakeDockerIIDFile)
+	defer cleanupCLI()
+
+	target, cleanup := newTestTarget(t, Config{})
+	defer cleanup()
+
+	_, err := target.DockerBuild().
+		SetRawProgress(false).
+		SetEnv("DOCKER_HOST", "tcp://builder:2375").
+		AddTag("image:latest").
+		SetSkipUnchanged(true).
+		BuildImage(context.TODO(), dir)
+	require.NoError(t, err)
+	requireFileContent(t, filepath.Join(dir, "host"), "tcp://builder:2375\n")
+}
+
+// fakeDockerIIDFile is a fake docker CLI script fragment that writes
+// the image ID to the --iidfile path
+const fakeDockerIIDFile = `
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--iidfile) echo "sha256:image" > "$2"; shift ;;
+	esac
+	shift
+done
+`
+
+func TestDockerBuildImageID(t *testing.T) {
+	dir, cleanupCLI := newFakeDockerCLI(t, `
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--metadata-file) echo '{}' > "$2"; shift ;;
+	esac
+	shift
+done
+`)
+	defer cleanupCLI()
+
+	target, cleanup := newTestTarget(t, Config{})
+	defer cleanup()
+
+	// a stale image ID from a previous build is not reported
+	iidfile := filepath.Join(dir, "iid")
+	require.NoError(t, ioutil.WriteFile(iidfile, []byte("sha256:stale"), 0644))
+	_, err := target.DockerBuild().SetRawProgress(false).SetIIDFile(iidfile).BuildImage(context.TODO(), dir)
+	require.Error(t, err)
+
+	// only exported results have no image ID
+	result, err := target.DockerBuild().
+		SetRawProgress(false).
+		AddOutput(DockerBuildOutput{Type: DockerOutputLocal, Dest: filepath.Join(dir, "out")}).
+		BuildImage(context.TODO(), dir)
+	require.NoError(t, err)
+	require.Empty(t, result.ImageID)
+}
+
+// newFakeDockerCLI installs a fake docker CLI that records its arguments
+// in the args file and runs script
+func newFakeDockerCLI(t *testing.T, script string) (dir string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "magnet-docker-cli")
+	require.NoError(t, err)
+
+	script = "#!/bin/sh\necho \"$@\" > \"$(dirname \"$0\")/args\"\n" + script
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0755))
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return dir, func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDockerIgnore(t *testing.T) {
+	ignore, err := parseDockerIgnore(strings.NewReader(`
+# comment
+*.log
+/build
+**/*.tmp
+docs/**/draft?.md
+vendor
+!vendor/keep
+[!a]bc
+`))
+	require.NoError(t, err)
+	require.True(t, ignore.exceptions)
+
+	for name, excluded := range map[string]bool{
+		"app.log":               true,
+		"logs/app.log":          false,
+		"build":                 true,
+		"build/bin/app":         true,
+		"src/build":             false,
+		"a.tmp":                 true,
+		"src/pkg/a.tmp":         true,
+		"docs/draft1.md":        true,
+		"docs/guide/draft2.md":  true,
+		"docs/guide/draft10.md": false,
+		"vendor/lib/lib.go":     true,
+		"vendor/keep":           false,
+		"vendor/keep/file":      false,
+		"xbc":                   true,
+		"abc":                   false,
+		"main.go":               false,
+	} {
+		require.Equal(t, excluded, ignore.excluded(name), name)
+	}
+}
+
+func TestDockerIgnoreDeepDirectories(t *testing.T) {
+	for _, patterns := range []string{"**/node_modules\n", "**/node_modules\n!**/node_modules/keep\n"} {
+		ignore, err := parseDockerIgnore(strings.NewReader(patterns))
+		require.NoError(t, err)
+		for name, excluded := range map[string]bool{
+			"node_modules":              true,
+			"node_modules/x":            true,
+			"a/b/node_modules":          true,
+			"a/b/node_modules/x":        true,
+			"a/b/node_modules/x/y":      true,
+			"a/b/node_modules_x":        false,
+			"a/b/node_modules/keep":     !ignore.exceptions,
+			"a/b/node_modules/keep/lib": !ignore.exceptions,
+		} {
+			require.Equal(t, excluded, ignore.excluded(name), "%v: %v", patterns, name)
+		}
+	}
+
+	src, err := ioutil.TempDir("", "magnet-context")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	for path, content := range map[string]string{
+		".dockerignore":                "**/node_modules\n!**/node_modules/keep\n",
+		"Dockerfile":                   "FROM scratch\n",
+		"a/b/node_modules/x/index.js":  "x",
+		"a/b/node_modules/keep/lib.js": "keep",
+		"a/b/main.js":                  "main",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(src, path)), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(src, path), []byte(content), 0644))
+	}
+	buildContext, err := readDockerContext(src, "")
+	require.NoError(t, err)
+	var names []string
+	for _, f := range buildContext.files {
+		if f.fi.Mode().IsRegular() {
+			names = append(names, f.name)
+		}
+	}
+	require.Equal(t, []string{".dockerignore", "Dockerfile", "a/b/main.js", "a/b/node_modules/keep/lib.js"}, names)
+}
+
+func TestDockerContextKeepsIgnoredDockerfile(t *testing.T) {
+	src, err := ioutil.TempDir("", "magnet-context")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	for path, content := range map[string]string{
+		".dockerignore":     "build\n",
+		"main.go":           "package main\n",
+		"build/Dockerfile":  "FROM scratch\n",
+		"build/output.bin":  "bin",
+		"build/cache/state": "state",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(src, path)), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(src, path), []byte(content), 0644))
+	}
+
+	buildContext, err := readDockerContext(src, filepath.Join(src, "build", "Dockerfile"))
+	require.NoError(t, err)
+	var names []string
+	for _, f := range buildContext.files {
+		names = append(names, f.name)
+	}
+	require.Equal(t, []string{".dockerignore", "build/Dockerfile", "main.go"}, names)
+}
+
+func TestDockerBuildCustomContext(t *testing.T) {
+	dir, cleanupCLI := newFakeDockerCLI(t, `cat > "$(dirname "$0")/context.tar"`+fakeDockerIIDFile)
+	defer cleanupCLI()
+
+	src, err := ioutil.TempDir("", "magnet-context")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	for path, content := range map[string]string{
+		"Dockerfile":          "FROM scratch\n",
+		".dockerignore":       "**/*.log\nassets/*\n!assets/logo.png\n",
+		"main.go":             "package main\n",
+		"debug.log":           "log",
+		"assets/logo.png":     "png",
+		"assets/big.bin":      "bin",
+		"pkg/lib/lib.go":      "package lib\n",
+		"pkg/lib/testing.log": "log",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(src, path)), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(src, path), []byte(content), 0644))
+	}
+
+	target, cleanup := newTestTarget(t, Config{})
+	defer cleanup()
+
+	build := target.DockerBuild().
+		SetRawProgress(false).
+		CopyToContext(filepath.Join(src, "main.go"), "/main.go", nil, nil).
+		CopyToContext(filepath.Join(src, "assets"), "/assets", nil, nil).
+		CopyToContext(filepath.Join(src, "pkg"), "/pkg", nil, nil)
+	expected := []string{"Dockerfile", "assets", "assets/logo.png", "main.go", "pkg", "pkg/lib", "pkg/lib/lib.go"}
+
+	files, err := build.ContextFiles(src)
+	require.NoError(t, err)
+	require.Equal(t, expected, files)
+
+	_, err = build.BuildImage(context.TODO(), src)
+	require.NoError(t, err)
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(strings.TrimSpace(string(args)), " -"), string(args))
+
+	f, err := os.Open(filepath.Join(dir, "context.tar"))
+	require.NoError(t, err)
+	defer f.Close()
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, strings.TrimSuffix(hdr.Name, "/"))
+	}
+	require.Equal(t, expected, names)
+
+	// the .dockerignore also applies to the context directory
+	files, err = target.DockerBuild().ContextFiles(src)
+	require.NoError(t, err)
+	require.Equal(t, []string{".dockerignore", "Dockerfile", "assets", "assets/logo.png", "main.go", "pkg", "pkg/lib", "pkg/lib/lib.go"}, files)
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
 	"sync"
 
@@ -23,6 +24,32 @@ type EnvVar struct {
 	Short   string
 	Long    string
 	Secret  bool
+	// SecretProvider optionally specifies the provider to resolve the value from
+	// if none of the configuration sources defines the variable.
+	// Variables with a provider are always treated as secrets
+	SecretProvider SecretProvider
+	// Aliases optionally lists deprecated names of the variable.
+	// Aliases are honored with a deprecation warning if the variable itself is not set.
+	// Within the same configuration source the variable takes precedence over its aliases,
+	// otherwise the source with the higher precedence wins
+	Aliases []string
+	// Namespace names the namespace the variable has been registered in.
+	// Set automatically when the variable is registered with EnvNamespace
+	Namespace string
+	// Source names the configuration source the value has been resolved from.
+	// Set automatically when the variable is registered
+	Source string
+	// Required marks the variable as mandatory.
+	// Required variables without a value or default are reported by Validate
+	Required bool
+
+	// Type optionally describes the type of the value.
+	// Set automatically by the typed accessors like EBool
+	Type string
+	// Allowed optionally lists the values allowed for an enum variable
+	Allowed []string
+	// Pattern optionally specifies the regular expression the value is validated against
+	Pattern string
 }
 
 // E defines a new environment variable specified with e.
@@ -34,6 +61,13 @@ func E(e EnvVar) string {
 	return env.E(e)
 }
 
+// ELazy defines a new environment variable specified with e
+// and returns the function to obtain its value on demand.
+// See Environ.ELazy for details
+func ELazy(e EnvVar) func() string {
+	return env.ELazy(e)
+}
+
 // MustGetEnv returns the value of the environment variable given with key.
 // The variable is assumed to have been registered either with E or
 // imported from existing environment - otherwise the function will panic.
@@ -54,18 +88,62 @@ func Env() map[string]EnvVar {
 	return env.Env()
 }
 
-// NewEnviron creates a new configuration environment
+// Validate checks the complete environment and reports all missing
+// required variables and variables with invalid values as a single error.
+// See Environ.Validate for details
+func Validate() error {
+	return env.Validate()
+}
+
+// NewEnviron creates a new configuration environment.
+// Values imported with importer take precedence over the process environment
 func NewEnviron(importer EnvImporterFunc) *Environ {
 	env = newEnviron(importer)
 	return env
 }
 
+// NewEnvironFromSources creates a new configuration environment from
+// the ordered list of sources.
+// Sources are given in the order of increasing precedence: values from
+// later sources override values from the earlier ones.
+// Variable defaults have the lowest precedence.
+//
+// A typical chain is:
+//
+//	magnet.NewEnvironFromSources(
+//		magnet.EnvSourceConfigFile("build.yaml"),
+//		magnet.EnvSourceMakefile(),
+//		magnet.EnvSourceProcess(),
+//		magnet.EnvSourceOverrides("command line", overrides),
+//	)
+func NewEnvironFromSources(sources ...EnvSource) *Environ {
+	env = newEnvironFromSources(sources...)
+	return env
+}
+
 // E defines a new environment variable specified with e.
 // Returns the current value of the variable with precedence
 // given to previously imported environment variables.
 // If the variable was not previously imported and no value
-// has been specified, the default is returned
+// has been specified, the default is returned.
+// Values of variables with a secret provider are resolved on first use
 func (r *Environ) E(e EnvVar) string {
+	r.register(e)
+	return r.MustGetEnv(e.Key)
+}
+
+// ELazy defines a new environment variable specified with e.
+// Unlike E, the value is not resolved until the returned function is called
+// for the first time, so the secret provider of the variable (e.g. a helper command)
+// only runs for targets that actually need the value
+func (r *Environ) ELazy(e EnvVar) func() string {
+	r.register(e)
+	return func() string {
+		return r.MustGetEnv(e.Key)
+	}
+}
+
+func (r *Environ) register(e EnvVar) {
 	if e.Key == "" {
 		panic("key shouldn't be empty")
 	}
@@ -73,15 +151,47 @@ func (r *Environ) E(e EnvVar) string {
 		panic("secrets shouldn't be embedded with defaults")
 	}
 
+	if e.SecretProvider != nil {
+		e.Secret = true
+	}
+
 	r.importOnce()
-	if v, ok := r.imported[e.Key]; ok {
-		e.Value = v
-	} else {
-		e.Value = os.Getenv(e.Key)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pending, e.Key)
+	delete(r.secretErrors, e.Key)
+	var alias string
+	e.Value, e.Source, alias = r.lookup(e.Key, e.Aliases...)
+	if alias != "" {
+		e.Source = fmt.Sprintf("%v (%v)", e.Source, alias)
+	}
+	if alias != "" && !r.deprecated[alias] {
+		r.deprecated[alias] = true
+		r.deprecations = append(r.deprecations, fmt.Sprintf(
+			"Environment variable %v is deprecated and will be removed in a future release, use %v instead.",
+			alias, e.Key))
+	}
+	for _, alias := range e.Aliases {
+		r.aliases[alias] = e.Key
+	}
+	if e.Value == "" && e.SecretProvider != nil {
+		r.pending[e.Key] = true
+	}
+	if e.Value == "" {
+		e.Source = ""
+		if e.Default != "" {
+			e.Source = EnvSourceDefault
+		}
+	}
+	if e.Secret {
+		r.RegisterSecret(e.Value)
+	}
+	if existing, ok := r.env[e.Key]; ok {
+		if err := checkConflict(existing, e); err != nil {
+			r.conflicts[e.Key] = err
+		}
 	}
 	r.env[e.Key] = e
-
-	return r.MustGetEnv(e.Key)
 }
 
 // MustGetEnv returns the value of the environment variable given with key.
@@ -100,6 +210,18 @@ func (r *Environ) MustGetEnv(key string) (value string) {
 // imported from existing environment
 func (r *Environ) GetEnv(key string) (value string, exists bool) {
 	r.importOnce()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.getEnv(key)
+}
+
+// getEnv returns the value of the environment variable given with key.
+// Must be called with r.mu held
+func (r *Environ) getEnv(key string) (value string, exists bool) {
+	if canonical, ok := r.aliases[key]; ok {
+		key = canonical
+	}
+	r.resolvePending(key)
 	var v EnvVar
 	if v, exists = r.env[key]; !exists {
 		return "", false
@@ -112,6 +234,9 @@ func (r *Environ) GetEnv(key string) (value string, exists bool) {
 
 // Env returns the complete environment
 func (r *Environ) Env() map[string]EnvVar {
+	r.importOnce()
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	m := make(map[string]EnvVar, len(r.env))
 	for key, value := range r.env {
 		def := value.Default
@@ -124,14 +249,160 @@ func (r *Environ) Env() map[string]EnvVar {
 	return m
 }
 
+// Validate checks all registered variables and reports all required
+// variables without a value, all variables with invalid values and all
+// variables registered multiple times with conflicting definitions
+// as a single aggregated error.
+// Required variables with a secret provider are resolved to check their values.
+// Returns nil if the environment is valid
+func (r *Environ) Validate() error {
+	r.importOnce()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make([]string, 0, len(r.env))
+	for key := range r.env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errors []error
+	for _, key := range keys {
+		if err, ok := r.conflicts[key]; ok {
+			errors = append(errors, err)
+		}
+		if err, ok := r.invalid[key]; ok {
+			errors = append(errors, err)
+			continue
+		}
+		e := r.env[key]
+		if !e.Required {
+			continue
+		}
+		value, _ := r.getEnv(key)
+		if err, ok := r.secretErrors[key]; ok {
+			errors = append(errors, err)
+			continue
+		}
+		if value == "" {
+			errors = append(errors, trace.NotFound("%v: required variable is not set", e.describe()))
+		}
+	}
+	return trace.NewAggregate(errors...)
+}
+
+// takeDeprecations returns and clears the pending deprecation warnings
+func (r *Environ) takeDeprecations() (warnings []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	warnings, r.deprecations = r.deprecations, nil
+	return warnings
+}
+
 // Environ represents the environment with configuration
 type Environ struct {
 	// env specifies the builder's configuration from environment
 	env map[string]EnvVar
 	// imported optionally specifies environment overrides
+	// merged from all sources except the process environment
 	imported map[string]string
-	importer EnvImporterFunc
-	once     sync.Once
+	// invalid maps keys of variables with invalid values to validation errors
+	invalid map[string]error
+	// conflicts maps keys of variables registered multiple times with
+	// conflicting definitions to errors
+	conflicts map[string]error
+	// pending lists keys of variables with a secret provider that
+	// have not been resolved yet
+	pending map[string]bool
+	// secretErrors maps keys of required variables to errors
+	// resolving their values from secret providers
+	secretErrors map[string]error
+	// aliases maps deprecated aliases to the keys of registered variables
+	aliases map[string]string
+	// deprecations lists pending warnings about deprecated aliases in use
+	deprecations []string
+	// deprecated lists deprecated aliases that have been warned about
+	deprecated map[string]bool
+	// sources lists configuration sources in the order of increasing precedence
+	sources []EnvSource
+	// layers lists the values imported from sources in the same order.
+	// Sources that look up values on demand have no layer
+	layers []map[string]string
+	once   sync.Once
+	// mu guards the registered variables along with their validation state
+	// and the resolution of pending variables
+	mu sync.Mutex
+
+	secretsMu sync.Mutex
+	// secrets lists literal secret values to redact from the log output
+	secrets []string
+}
+
+// EnvSource describes a named source of configuration values
+type EnvSource struct {
+	// Name identifies the source in the help output and logs
+	Name string
+	// Import imports the values from the source
+	Import EnvImporterFunc
+	// lookup optionally looks up values on demand instead of importing
+	// them once. Used for the process environment so that changes made after
+	// the environment has been initialized are visible
+	lookup func(key string) (string, bool)
+}
+
+const (
+	// EnvSourceDefault names the source of values obtained from EnvVar.Default
+	EnvSourceDefault = "default"
+	// EnvSourceProcessName names the source of values obtained from the process environment
+	EnvSourceProcessName = "environment"
+	// EnvSourceMakefileName names the source of values imported from the Makefile
+	EnvSourceMakefileName = "Makefile"
+)
+
+// EnvSourceProcess returns the source that provides values from the process environment
+func EnvSourceProcess() EnvSource {
+	return EnvSource{
+		Name:   EnvSourceProcessName,
+		Import: importEnvFromProcess,
+		lookup: os.LookupEnv,
+	}
+}
+
+// EnvSourceMakefile returns the source that provides values imported from the Makefile.
+// See ImportEnvFromMakefile for details
+func EnvSourceMakefile() EnvSource {
+	return EnvSource{
+		Name:   EnvSourceMakefileName,
+		Import: ImportEnvFromMakefile,
+	}
+}
+
+// EnvSourceDotenv returns the source that provides values from the dotenv file at path.
+// See ImportEnvFromDotenv for details
+func EnvSourceDotenv(path string) EnvSource {
+	return EnvSource{
+		Name:   path,
+		Import: ImportEnvFromDotenv(path),
+	}
+}
+
+// EnvSourceConfigFile returns the source that provides values from the YAML/JSON file at path.
+// See ImportEnvFromConfigFile for details
+func EnvSourceConfigFile(path string) EnvSource {
+	return EnvSource{
+		Name:   path,
+		Import: ImportEnvFromConfigFile(path),
+	}
+}
+
+// EnvSourceOverrides returns the source with the specified name that provides the given values.
+// Use it to inject explicit overrides, e.g. parsed from the command line
+func EnvSourceOverrides(name string, values map[string]string) EnvSource {
+	return EnvSource{
+		Name: name,
+		Import: func() map[string]string {
+			return values
+		},
+	}
 }
 
 // ImportEnvFromMakefile invokes `make` to generate configuration for this mage script.
@@ -142,15 +413,26 @@ type Environ struct {
 // are used as default values for the configuration variables defined by the script.
 // Any errors are ignored since this is a best-effort operation.
 func ImportEnvFromMakefile() (env map[string]string) {
-	cmd := exec.Command("make", "magnet-vars")
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil
+	return ImportEnvFromMakefileWithPrefix(DefaultEnvPrefix)()
+}
+
+// ImportEnvFromMakefileWithPrefix returns an importer that works like ImportEnvFromMakefile
+// but only considers the variables with the specified prefix
+func ImportEnvFromMakefileWithPrefix(prefix string) EnvImporterFunc {
+	return func() map[string]string {
+		cmd := exec.Command("make", "magnet-vars")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return nil
+		}
+		env, _ := ImportEnvFromReaderWithPrefix(bytes.NewReader(out), prefix)
+		return env
 	}
-	env, _ = ImportEnvFromReader(bytes.NewReader(out))
-	return env
 }
 
+// DefaultEnvPrefix specifies the default prefix of the variables consumed by the importers
+const DefaultEnvPrefix = "MAGNET_"
+
 // EnvImporterFunc defines a function type to import environment from external source
 type EnvImporterFunc func() map[string]string
 
@@ -160,6 +442,13 @@ type EnvImporterFunc func() map[string]string
 // Only the environment variables prefixed with `MAGNET_` are considered which
 // are used as default values for the configuration variables defined by the script itself.
 func ImportEnvFromReader(r io.Reader) (env map[string]string, err error) {
+	return ImportEnvFromReaderWithPrefix(r, DefaultEnvPrefix)
+}
+
+// ImportEnvFromReaderWithPrefix works like ImportEnvFromReader but only considers the
+// environment variables with the specified prefix.
+// The prefix is stripped from the resulting keys
+func ImportEnvFromReaderWithPrefix(r io.Reader, prefix string) (env map[string]string, err error) {
 	env = make(map[string]string)
 
 	s := bufio.NewScanner(r)
@@ -169,11 +458,11 @@ func ImportEnvFromReader(r io.Reader) (env map[string]string, err error) {
 			continue
 		}
 		cols := strings.SplitN(line, "=", 2)
-		if len(cols) != 2 || !strings.HasPrefix(cols[0], "MAGNET_") {
+		if len(cols) != 2 || !strings.HasPrefix(cols[0], prefix) {
 			log.Printf("Skip line that does not look like magnet envar: %q\n", line)
 			continue
 		}
-		key, value := strings.TrimPrefix(cols[0], "MAGNET_"), cols[1]
+		key, value := strings.TrimPrefix(cols[0], prefix), cols[1]
 		env[key] = value
 	}
 	if s.Err() != nil {
@@ -183,21 +472,83 @@ func ImportEnvFromReader(r io.Reader) (env map[string]string, err error) {
 }
 
 // env represents the default configuration environment
-var env = newEnviron(ImportEnvFromMakefile)
+var env = newEnvironFromSources(EnvSourceMakefile(), EnvSourceProcess())
 
 func newEnviron(importer EnvImporterFunc) *Environ {
+	return newEnvironFromSources(EnvSourceProcess(), EnvSource{
+		Name:   "imported",
+		Import: importer,
+	})
+}
+
+func newEnvironFromSources(sources ...EnvSource) *Environ {
 	return &Environ{
-		importer: importer,
-		env:      make(map[string]EnvVar),
+		sources:      sources,
+		env:          make(map[string]EnvVar),
+		invalid:      make(map[string]error),
+		pending:      make(map[string]bool),
+		secretErrors: make(map[string]error),
+		aliases:      make(map[string]string),
+		deprecated:   make(map[string]bool),
+		conflicts:    make(map[string]error),
 	}
 }
 
 func (r *Environ) importOnce() {
 	r.once.Do(func() {
-		r.imported = r.importer()
+		r.imported = make(map[string]string)
+		r.layers = make([]map[string]string, len(r.sources))
+		for i, source := range r.sources {
+			if source.lookup != nil {
+				continue
+			}
+			values := source.Import()
+			r.layers[i] = values
+			for key, value := range values {
+				r.imported[key] = value
+			}
+		}
 	})
 }
 
+// lookup returns the value for the specified key from the source
+// with the highest precedence along with the name of the source.
+// Within a single source, the key takes precedence over its aliases and
+// aliases are considered in the order given.
+// alias is set to the deprecated alias the value has been found with, if any.
+// Returns empty values if none of the sources defines the key
+func (r *Environ) lookup(key string, aliases ...string) (value, source, alias string) {
+	for i := len(r.layers) - 1; i >= 0; i-- {
+		if value, ok := r.lookupLayer(i, key); ok {
+			return value, r.sources[i].Name, ""
+		}
+		for _, alias := range aliases {
+			if value, ok := r.lookupLayer(i, alias); ok {
+				return value, r.sources[i].Name, alias
+			}
+		}
+	}
+	return "", "", ""
+}
+
+func (r *Environ) lookupLayer(i int, key string) (value string, ok bool) {
+	if lookup := r.sources[i].lookup; lookup != nil {
+		return lookup(key)
+	}
+	value, ok = r.layers[i][key]
+	return value, ok
+}
+
+func importEnvFromProcess() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if cols := strings.SplitN(kv, "=", 2); len(cols) == 2 {
+			env[cols[0]] = cols[1]
+		}
+	}
+	return env
+}
+
 var debianFrontend = E(EnvVar{
 	Key:   "DEBIAN_FRONTEND",
 	Short: "Set to noninteractive or stderr to null to enable non-interactive output",
@@ -208,3 +559,70 @@ var cacheDir = E(EnvVar{
 	Short:   "Location to store/cache build assets",
 	Default: "_build/cache",
 })
+
+var downloadLockRefresh = EBool(EnvVar{
+	Key:   "DOWNLOAD_LOCK_REFRESH",
+	Short: "Set to true to record new digests of downloaded files in the download lock file instead of verifying them",
+})
+
+var downloadOffline = EBool(EnvVar{
+	Key:   "DOWNLOAD_OFFLINE",
+	Short: "Set to true to serve downloads only from the cache without contacting upstream servers",
+})
+
+var downloadMirrors = E(EnvVar{
+	Key:   "DOWNLOAD_MIRRORS",
+	Short: "Whitespace-separated list of <prefix>=><url> download mirrors tried in order if the upstream download fails",
+})
+
+var downloadRewrites = E(EnvVar{
+	Key:   "DOWNLOAD_REWRITES",
+	Short: "Whitespace-separated list of <prefix>=><replacement> rules to rewrite download URLs",
+})
+
+var cacheMaxSize = E(EnvVar{
+	Key:   "CACHE_MAX_SIZE",
+	Short: "Maximum size of the cache directory (e.g. 512M or 10G), the least recently used entries are removed once a day and by cache:gc",
+})
+
+var cacheMaxAge = EDuration(EnvVar{
+	Key:   "CACHE_MAX_AGE",
+	Short: "Duration after which unused cache entries are removed once a day and by cache:gc (e.g. 720h)",
+})
+
+var downloadCABundle = E(EnvVar{
+	Key:   "DOWNLOAD_CA_BUNDLE",
+	Short: "Path to the PEM bundle of additional certificate authorities trusted for downloads",
+})
+
+var downloadConnectTimeout = EDuration(EnvVar{
+	Key:     "DOWNLOAD_CONNECT_TIMEOUT",
+	Default: "30s",
+	Short:   "Timeout to establish the connection for downloads",
+})
+
+var downloadIdleTimeout = EDuration(EnvVar{
+	Key:     "DOWNLOAD_IDLE_TIMEOUT",
+	Default: "5m",
+	Short:   "Timeout to abort a download if no data has been received",
+})
+
+var dockerHost = E(EnvVar{
+	Key:   "DOCKER_HOST",
+	Short: "Address of the Docker Engine API, e.g. unix:///var/run/docker.sock",
+})
+
+var dockerCertPath = E(EnvVar{
+	Key:   "DOCKER_CERT_PATH",
+	Short: "Directory with the TLS certificates (ca.pem, cert.pem and key.pem) for the Docker Engine API, used with DOCKER_TLS_VERIFY",
+})
+
+var dockerTLSVerify = E(EnvVar{
+	Key:   "DOCKER_TLS_VERIFY",
+	Short: "Set to use TLS and verify the certificate of the Docker Engine API",
+})
+
+var dockerBackend = EEnum(EnvVar{
+	Key:   "DOCKER_BACKEND",
+	Short: "Backend to run docker commands with: the docker CLI or the Engine API",
+}, DockerBackendCLI, DockerBackendAPI)
@@ -0,0 +1,232 @@
+package magnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"github.com/olekukonko/tablewriter"
+)
+
+const (
+	// EnvFormatTable formats the environment as an ASCII table
+	EnvFormatTable = "table"
+	// EnvFormatJSON formats the environment as a JSON array
+	EnvFormatJSON = "json"
+	// EnvFormatMarkdown formats the environment documentation as a Markdown table
+	EnvFormatMarkdown = "markdown"
+	// EnvFormatShell formats the environment as a shell script with export statements
+	EnvFormatShell = "shell"
+	// EnvFormatGithub formats the environment in the format of the GitHub Actions $GITHUB_ENV file
+	EnvFormatGithub = "github"
+)
+
+// EnvFormats lists all supported environment output formats
+var EnvFormats = []string{EnvFormatTable, EnvFormatJSON, EnvFormatMarkdown, EnvFormatShell, EnvFormatGithub}
+
+const redacted = "<redacted>"
+
+// WriteEnv writes the complete environment to w in the specified format.
+// See Environ.WriteEnv for details
+func WriteEnv(w io.Writer, format string) error {
+	return env.WriteEnv(w, format)
+}
+
+// WriteEnv writes the complete environment to w in the specified format.
+// Values of secret variables are always redacted: they are masked in the table,
+// JSON and Markdown output, commented out in the shell script
+// and omitted from the GitHub Actions environment file
+func (r *Environ) WriteEnv(w io.Writer, format string) error {
+	vars := sortedEnv(r.Env())
+	switch format {
+	case EnvFormatTable:
+		return writeEnvTable(w, vars)
+	case EnvFormatJSON:
+		return writeEnvJSON(w, vars)
+	case EnvFormatMarkdown:
+		return writeEnvMarkdown(w, vars)
+	case EnvFormatShell:
+		return writeEnvShell(w, vars)
+	case EnvFormatGithub:
+		return writeEnvGithub(w, vars)
+	}
+	return trace.BadParameter("unsupported format %q, expected one of [%v]", format, strings.Join(EnvFormats, ", "))
+}
+
+// effectiveValue returns the value of the variable falling back to the default
+func (e EnvVar) effectiveValue() string {
+	if e.Value != "" {
+		return e.Value
+	}
+	return e.Default
+}
+
+func writeEnvTable(w io.Writer, vars []EnvVar) error {
+	var result [][]string
+	for _, e := range vars {
+		short := e.Short
+		if e.Required {
+			short = "(required) " + short
+		}
+		if len(e.Aliases) != 0 {
+			short += fmt.Sprintf(" (deprecated: %v)", strings.Join(e.Aliases, ", "))
+		}
+		if e.Secret {
+			result = append(result, []string{e.Key, redacted, "", e.Source, e.TypeInfo(), short})
+		} else {
+			result = append(result, []string{e.Key, e.Value, e.Default, e.Source, e.TypeInfo(), short})
+		}
+	}
+
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Env", "Value", "Default", "Source", "Type", "Short Description"})
+	table.SetBorder(false)
+	table.SetAutoWrapText(false)
+	table.SetReflowDuringAutoWrap(false)
+
+	table.AppendBulk(result)
+	table.Render()
+
+	return nil
+}
+
+type envVarJSON struct {
+	Key         string   `json:"key"`
+	Value       string   `json:"value"`
+	Default     string   `json:"default,omitempty"`
+	Source      string   `json:"source,omitempty"`
+	Type        string   `json:"type"`
+	Allowed     []string `json:"allowed,omitempty"`
+	Aliases     []string `json:"deprecatedAliases,omitempty"`
+	Pattern     string   `json:"pattern,omitempty"`
+	Required    bool     `json:"required,omitempty"`
+	Secret      bool     `json:"secret,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Long        string   `json:"long,omitempty"`
+}
+
+func writeEnvJSON(w io.Writer, vars []EnvVar) error {
+	result := make([]envVarJSON, 0, len(vars))
+	for _, e := range vars {
+		v := envVarJSON{
+			Key:         e.Key,
+			Value:       e.Value,
+			Default:     e.Default,
+			Source:      e.Source,
+			Type:        e.Type,
+			Allowed:     e.Allowed,
+			Aliases:     e.Aliases,
+			Pattern:     e.Pattern,
+			Required:    e.Required,
+			Secret:      e.Secret,
+			Description: e.Short,
+			Long:        e.Long,
+		}
+		if v.Type == "" {
+			v.Type = EnvTypeString
+		}
+		if e.Secret {
+			v.Value, v.Default = redacted, ""
+		}
+		result = append(result, v)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return trace.Wrap(enc.Encode(result))
+}
+
+func writeEnvMarkdown(w io.Writer, vars []EnvVar) error {
+	var b strings.Builder
+	b.WriteString("| Variable | Default | Type | Required | Description |\n")
+	b.WriteString("|----------|---------|------|----------|-------------|\n")
+	for _, e := range vars {
+		def := e.Default
+		if e.Secret {
+			def = ""
+		}
+		if def != "" {
+			def = "`" + def + "`"
+		}
+		required := ""
+		if e.Required {
+			required = "yes"
+		}
+		description := e.Short
+		if e.Long != "" {
+			description = strings.TrimSpace(description + " " + e.Long)
+		}
+		if len(e.Aliases) != 0 {
+			description += fmt.Sprintf(" Deprecated aliases: `%v`.", strings.Join(e.Aliases, "`, `"))
+		}
+		fmt.Fprintf(&b, "| `%v` | %v | %v | %v | %v |\n",
+			e.Key, escapeMarkdown(def), escapeMarkdown(e.TypeInfo()), required, escapeMarkdown(description))
+	}
+	_, err := io.WriteString(w, b.String())
+	return trace.Wrap(err)
+}
+
+func writeEnvShell(w io.Writer, vars []EnvVar) error {
+	var b strings.Builder
+	for _, e := range vars {
+		value := e.effectiveValue()
+		if value == "" {
+			continue
+		}
+		if e.Short != "" {
+			fmt.Fprintf(&b, "# %v\n", strings.ReplaceAll(e.Short, "\n", " "))
+		}
+		if e.Secret {
+			fmt.Fprintf(&b, "# export %v=%v\n", e.Key, redacted)
+			continue
+		}
+		fmt.Fprintf(&b, "export %v=%v\n", e.Key, shellQuote(value))
+	}
+	_, err := io.WriteString(w, b.String())
+	return trace.Wrap(err)
+}
+
+func writeEnvGithub(w io.Writer, vars []EnvVar) error {
+	var b strings.Builder
+	for _, e := range vars {
+		value := e.effectiveValue()
+		if value == "" || e.Secret {
+			continue
+		}
+		if !strings.Contains(value, "\n") {
+			fmt.Fprintf(&b, "%v=%v\n", e.Key, value)
+			continue
+		}
+		delimiter := "MAGNET_EOF"
+		for strings.Contains(value, delimiter) {
+			delimiter += "_"
+		}
+		fmt.Fprintf(&b, "%v<<%v\n%v\n%v\n", e.Key, delimiter, value, delimiter)
+	}
+	_, err := io.WriteString(w, b.String())
+	return trace.Wrap(err)
+}
+
+func sortedEnv(env map[string]EnvVar) []EnvVar {
+	vars := make([]EnvVar, 0, len(env))
+	for _, e := range env {
+		vars = append(vars, e)
+	}
+	sort.Slice(vars, func(i, j int) bool {
+		return vars[i].Key < vars[j].Key
+	})
+	return vars
+}
+
+// shellQuote quotes s for use in a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func escapeMarkdown(s string) string {
+	s = strings.ReplaceAll(s, "|", `\|`)
+	return strings.ReplaceAll(s, "\n", "<br>")
+}
@@ -0,0 +1,251 @@
+package magnet
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gravitational/trace"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ImportEnvFromDotenv returns an importer that reads configuration from the dotenv
+// file at the specified path. See ImportEnvFromDotenvReader for the supported syntax.
+// A missing file is not an error and results in an empty configuration.
+// Any other errors are logged and ignored since this is a best-effort operation.
+func ImportEnvFromDotenv(path string) EnvImporterFunc {
+	return func() map[string]string {
+		f, err := os.Open(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Failed to open dotenv file %v: %v.\n", path, err)
+			}
+			return nil
+		}
+		defer f.Close()
+		env, err := ImportEnvFromDotenvReader(f)
+		if err != nil {
+			log.Printf("Failed to import dotenv file %v: %v.\n", path, trace.UserMessage(err))
+			return nil
+		}
+		return env
+	}
+}
+
+// ImportEnvFromConfigFile returns an importer that reads configuration from the YAML
+// or JSON file at the specified path. See ImportEnvFromConfigReader for the expected format.
+// A missing file is not an error and results in an empty configuration.
+// Any other errors are logged and ignored since this is a best-effort operation.
+func ImportEnvFromConfigFile(path string) EnvImporterFunc {
+	return func() map[string]string {
+		f, err := os.Open(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Failed to open config file %v: %v.\n", path, err)
+			}
+			return nil
+		}
+		defer f.Close()
+		env, err := ImportEnvFromConfigReader(f)
+		if err != nil {
+			log.Printf("Failed to import config file %v: %v.\n", path, trace.UserMessage(err))
+			return nil
+		}
+		return env
+	}
+}
+
+// ImportEnvFromDotenvReader consumes configuration in dotenv format from the specified reader.
+// Supports:
+//   - blank lines and comments starting with `#`
+//   - an optional `export ` prefix
+//   - unquoted values with trailing comments (` # comment`)
+//   - single-quoted values taken literally
+//   - double-quoted values spanning multiple lines with escape sequences (\n, \t, \", \\, \$)
+//   - `${VAR}`, `$VAR` and `${VAR:-default}` interpolation in unquoted and double-quoted values.
+//     Variables are resolved from the previously defined keys and then from the process environment
+func ImportEnvFromDotenvReader(r io.Reader) (env map[string]string, err error) {
+	env = make(map[string]string)
+	lookup := func(key string) (string, bool) {
+		if v, ok := env[key]; ok {
+			return v, true
+		}
+		return os.LookupEnv(key)
+	}
+
+	s := bufio.NewScanner(r)
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		cols := strings.SplitN(line, "=", 2)
+		if len(cols) != 2 {
+			return nil, trace.BadParameter("line %v: expected KEY=value, got %q", lineno, line)
+		}
+		key, value := strings.TrimSpace(cols[0]), strings.TrimLeft(cols[1], " \t")
+		if !isValidEnvKey(key) {
+			return nil, trace.BadParameter("line %v: invalid variable name %q", lineno, key)
+		}
+
+		switch {
+		case strings.HasPrefix(value, "'"):
+			end := strings.Index(value[1:], "'")
+			if end < 0 {
+				return nil, trace.BadParameter("line %v: unterminated single-quoted value for %v", lineno, key)
+			}
+			env[key] = value[1 : end+1]
+		case strings.HasPrefix(value, `"`):
+			value = value[1:]
+			for {
+				unquoted, ok := unquoteDotenv(value)
+				if ok {
+					env[key] = os.Expand(unquoted, expandFunc(lookup))
+					break
+				}
+				if !s.Scan() {
+					return nil, trace.BadParameter("line %v: unterminated double-quoted value for %v", lineno, key)
+				}
+				lineno++
+				value += "\n" + s.Text()
+			}
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = value[:i]
+			}
+			env[key] = os.Expand(strings.TrimSpace(value), expandFunc(lookup))
+		}
+	}
+	if s.Err() != nil {
+		return nil, trace.Wrap(s.Err())
+	}
+	return env, nil
+}
+
+// ImportEnvFromConfigReader consumes configuration from the specified reader in YAML or JSON
+// format. The document is expected to be a flat mapping of variable names to values.
+// Scalar values are used verbatim as written in the document (e.g. `1.10` stays `1.10`),
+// lists of scalars are joined with commas
+// (in the format expected by EList). Nested mappings are not supported
+func ImportEnvFromConfigReader(r io.Reader) (env map[string]string, err error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var config map[string]configValue
+	if err := yaml.Unmarshal(buf, &config); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	env = make(map[string]string, len(config))
+	for key, value := range config {
+		if !isValidEnvKey(key) {
+			return nil, trace.BadParameter("invalid variable name %q", key)
+		}
+		if value.invalid {
+			return nil, trace.BadParameter("%v: expected a scalar value or a list of scalar values", key)
+		}
+		env[key] = value.value
+	}
+	return env, nil
+}
+
+// configValue is a configuration value that preserves the literal text
+// of scalars (e.g. `1.10` or large integers) instead of reformatting
+// their resolved numeric values.
+// Lists of scalars are joined with commas
+type configValue struct {
+	value string
+	// invalid is set if the value is neither a scalar nor a list of scalars
+	invalid bool
+}
+
+// UnmarshalYAML decodes the value from YAML.
+// Implements yaml.Unmarshaler
+func (r *configValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err == nil {
+		*r = configValue{value: value}
+		return nil
+	}
+	var items []string
+	if err := unmarshal(&items); err != nil {
+		*r = configValue{invalid: true}
+		return nil
+	}
+	*r = configValue{value: strings.Join(items, ",")}
+	return nil
+}
+
+// unquoteDotenv processes escape sequences in the double-quoted value s
+// up to the closing quote.
+// Returns false if the value does not have the closing quote.
+// Escaped dollar signs are preserved as `$$` for the following expansion
+func unquoteDotenv(s string) (result string, ok bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return b.String(), true
+		case '\\':
+			if i+1 == len(s) {
+				b.WriteByte(c)
+				continue
+			}
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '$':
+				b.WriteString("$$")
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", false
+}
+
+// expandFunc returns a mapping function for os.Expand that resolves
+// variables with lookup and supports the `VAR:-default` form.
+// `$$` expands to a literal dollar sign
+func expandFunc(lookup func(string) (string, bool)) func(string) string {
+	return func(key string) string {
+		if key == "$" {
+			return "$"
+		}
+		key, def := key, ""
+		if i := strings.Index(key, ":-"); i >= 0 {
+			key, def = key[:i], key[i+2:]
+		}
+		if v, ok := lookup(key); ok && v != "" {
+			return v
+		}
+		return def
+	}
+}
+
+func isValidEnvKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i, c := range key {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package magnet
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// EnvNamespace defines a set of environment variables with a common key prefix.
+// Namespaces allow several packages (e.g. shared helpers and a product magefile)
+// to define variables with the same name without clashing
+type EnvNamespace struct {
+	// env optionally specifies the environment the namespace belongs to.
+	// If unspecified, the default environment at the time of the call is used
+	env    *Environ
+	name   string
+	prefix string
+}
+
+// Namespace returns a new namespace with the specified name in the default environment.
+// Keys of all variables defined in the namespace are prefixed with prefix.
+// See Environ.Namespace for details
+func Namespace(name, prefix string) *EnvNamespace {
+	return &EnvNamespace{name: name, prefix: prefix}
+}
+
+// Namespace returns a new namespace with the specified name.
+// Keys of all variables defined in the namespace are prefixed with prefix,
+// e.g. VERSION in a namespace with the prefix COMMON_ is resolved as COMMON_VERSION
+// (and imported from a Makefile as MAGNET_COMMON_VERSION).
+// Deprecated aliases are used as given and are not prefixed
+func (r *Environ) Namespace(name, prefix string) *EnvNamespace {
+	return &EnvNamespace{env: r, name: name, prefix: prefix}
+}
+
+// Name returns the name of this namespace
+func (r *EnvNamespace) Name() string {
+	return r.name
+}
+
+// Key returns the fully qualified key for the variable given with key
+func (r *EnvNamespace) Key(key string) string {
+	return r.prefix + key
+}
+
+// E defines a new environment variable specified with e in this namespace.
+// See Environ.E for details
+func (r *EnvNamespace) E(e EnvVar) string {
+	return r.environ().E(r.qualify(e))
+}
+
+// ELazy defines a new environment variable specified with e in this namespace
+// and returns the function to obtain its value on demand.
+// See Environ.ELazy for details
+func (r *EnvNamespace) ELazy(e EnvVar) func() string {
+	return r.environ().ELazy(r.qualify(e))
+}
+
+// EBool defines a new boolean environment variable specified with e in this namespace.
+// See Environ.EBool for details
+func (r *EnvNamespace) EBool(e EnvVar) bool {
+	return r.environ().EBool(r.qualify(e))
+}
+
+// EInt defines a new integer environment variable specified with e in this namespace.
+// See Environ.EInt for details
+func (r *EnvNamespace) EInt(e EnvVar) int {
+	return r.environ().EInt(r.qualify(e))
+}
+
+// EDuration defines a new duration environment variable specified with e in this namespace.
+// See Environ.EDuration for details
+func (r *EnvNamespace) EDuration(e EnvVar) time.Duration {
+	return r.environ().EDuration(r.qualify(e))
+}
+
+// EList defines a new list environment variable specified with e in this namespace.
+// See Environ.EList for details
+func (r *EnvNamespace) EList(e EnvVar) []string {
+	return r.environ().EList(r.qualify(e))
+}
+
+// EEnum defines a new enum environment variable specified with e in this namespace.
+// See Environ.EEnum for details
+func (r *EnvNamespace) EEnum(e EnvVar, allowed ...string) string {
+	return r.environ().EEnum(r.qualify(e), allowed...)
+}
+
+// ERegexp defines a new string environment variable specified with e in this namespace
+// that is validated against the given regular expression.
+// See Environ.ERegexp for details
+func (r *EnvNamespace) ERegexp(e EnvVar, pattern string) string {
+	return r.environ().ERegexp(r.qualify(e), pattern)
+}
+
+// MustGetEnv returns the value of the variable given with key in this namespace.
+// See Environ.MustGetEnv for details
+func (r *EnvNamespace) MustGetEnv(key string) string {
+	return r.environ().MustGetEnv(r.Key(key))
+}
+
+// GetEnv returns the value of the variable given with key in this namespace.
+// See Environ.GetEnv for details
+func (r *EnvNamespace) GetEnv(key string) (value string, exists bool) {
+	return r.environ().GetEnv(r.Key(key))
+}
+
+func (r *EnvNamespace) environ() *Environ {
+	if r.env != nil {
+		return r.env
+	}
+	return env
+}
+
+func (r *EnvNamespace) qualify(e EnvVar) EnvVar {
+	if e.Key == "" {
+		panic("key shouldn't be empty")
+	}
+	e.Key = r.Key(e.Key)
+	e.Namespace = r.name
+	return e
+}
+
+// checkConflict returns an error if the variable definitions
+// registered under the same key are in conflict
+func checkConflict(existing, e EnvVar) error {
+	var diffs []string
+	if existing.Default != e.Default {
+		diffs = append(diffs, fmt.Sprintf("default %q vs %q", existing.Default, e.Default))
+	}
+	if existing.Short != e.Short {
+		diffs = append(diffs, fmt.Sprintf("description %q vs %q", existing.Short, e.Short))
+	}
+	if len(diffs) == 0 {
+		return nil
+	}
+	return trace.AlreadyExists("%v: conflicting definitions in %v and %v: %v",
+		e.Key, namespaceName(existing.Namespace), namespaceName(e.Namespace), strings.Join(diffs, ", "))
+}
+
+func namespaceName(name string) string {
+	if name == "" {
+		return "the global namespace"
+	}
+	return fmt.Sprintf("namespace %q", name)
+}
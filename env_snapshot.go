@@ -0,0 +1,124 @@
+package magnet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/gravitational/trace"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// EnvSnapshotFile names the file the environment snapshot is written to in the run's log directory
+const EnvSnapshotFile = "env.yaml"
+
+// EnvSnapshot records the resolved environment of a single run.
+// Maps variable keys to the resolved values
+type EnvSnapshot map[string]EnvSnapshotVar
+
+// EnvSnapshotVar records the resolved value of a single variable
+type EnvSnapshotVar struct {
+	// Value specifies the effective value of the variable.
+	// Values of secret variables are redacted
+	Value string `yaml:"value"`
+	// Default specifies the default value of the variable
+	Default string `yaml:"default,omitempty"`
+	// Source names the configuration source the value has been resolved from
+	Source string `yaml:"source,omitempty"`
+	// Secret specifies whether the variable is a secret
+	Secret bool `yaml:"secret,omitempty"`
+}
+
+// EnvChange describes the difference for a single variable between two snapshots
+type EnvChange struct {
+	// Key identifies the variable
+	Key string
+	// Old is the variable in the old snapshot or nil, if the variable has been added
+	Old *EnvSnapshotVar
+	// New is the variable in the new snapshot or nil, if the variable has been removed
+	New *EnvSnapshotVar
+}
+
+// Snapshot returns the redacted snapshot of the complete environment
+func Snapshot() EnvSnapshot {
+	return env.Snapshot()
+}
+
+// Snapshot returns the redacted snapshot of the complete environment
+func (r *Environ) Snapshot() EnvSnapshot {
+	vars := r.Env()
+	snapshot := make(EnvSnapshot, len(vars))
+	for key, e := range vars {
+		v := EnvSnapshotVar{
+			Value:   e.effectiveValue(),
+			Default: e.Default,
+			Source:  e.Source,
+			Secret:  e.Secret,
+		}
+		if e.Secret {
+			v.Default = ""
+			if v.Value != "" {
+				v.Value = redacted
+			}
+		}
+		snapshot[key] = v
+	}
+	return snapshot
+}
+
+// LoadEnvSnapshot reads the environment snapshot from path.
+// path is either the snapshot file or the log directory of a run
+func LoadEnvSnapshot(path string) (EnvSnapshot, error) {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, EnvSnapshotFile)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	var snapshot EnvSnapshot
+	if err := yaml.Unmarshal(buf, &snapshot); err != nil {
+		return nil, trace.Wrap(err, "invalid environment snapshot %v", path)
+	}
+	return snapshot, nil
+}
+
+// DiffEnvSnapshots compares the snapshots and returns the list of changed variables sorted by key.
+// Variables are considered changed if their value or source differ
+func DiffEnvSnapshots(old, new EnvSnapshot) (changes []EnvChange) {
+	keys := make(map[string]struct{}, len(old)+len(new))
+	for key := range old {
+		keys[key] = struct{}{}
+	}
+	for key := range new {
+		keys[key] = struct{}{}
+	}
+
+	for key := range keys {
+		change := EnvChange{Key: key}
+		if v, ok := old[key]; ok {
+			change.Old = &v
+		}
+		if v, ok := new[key]; ok {
+			change.New = &v
+		}
+		if change.Old != nil && change.New != nil &&
+			change.Old.Value == change.New.Value && change.Old.Source == change.New.Source {
+			continue
+		}
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
+
+func (r EnvSnapshot) write(path string) error {
+	buf, err := yaml.Marshal(r)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.ConvertSystemError(ioutil.WriteFile(path, buf, 0644))
+}
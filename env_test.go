@@ -1,9 +1,18 @@
 package magnet
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gravitational/trace"
 	"github.com/stretchr/testify/require"
 )
 
@@ -43,3 +52,373 @@ PKG_VERSION=v2.0
 		})
 	}
 }
+
+func TestTypedAccessors(t *testing.T) {
+	env := newEnviron(func() map[string]string {
+		return map[string]string{
+			"TEST_BOOL":     "yes",
+			"TEST_INT":      "42",
+			"TEST_DURATION": "1m30s",
+			"TEST_LIST":     " a, b,,c ",
+			"TEST_ENUM":     "release",
+			"TEST_REGEXP":   "v1.2.3",
+		}
+	})
+
+	require.True(t, env.EBool(EnvVar{Key: "TEST_BOOL"}))
+	require.Equal(t, 42, env.EInt(EnvVar{Key: "TEST_INT"}))
+	require.Equal(t, 90*time.Second, env.EDuration(EnvVar{Key: "TEST_DURATION"}))
+	require.Equal(t, []string{"a", "b", "c"}, env.EList(EnvVar{Key: "TEST_LIST"}))
+	require.Equal(t, "release", env.EEnum(EnvVar{Key: "TEST_ENUM"}, "debug", "release"))
+	require.Equal(t, "v1.2.3", env.ERegexp(EnvVar{Key: "TEST_REGEXP"}, `^v\d+\.\d+\.\d+$`))
+	require.Equal(t, 10, env.EInt(EnvVar{Key: "TEST_INT_DEFAULT", Default: "10"}))
+	require.NoError(t, env.Err())
+	require.Equal(t, "enum (debug|release)", env.Env()["TEST_ENUM"].TypeInfo())
+}
+
+func TestTypedAccessorsAggregateErrors(t *testing.T) {
+	env := newEnviron(func() map[string]string {
+		return map[string]string{
+			"TEST_BOOL": "maybe",
+			"TEST_INT":  "many",
+			"TEST_ENUM": "fast",
+		}
+	})
+
+	env.EBool(EnvVar{Key: "TEST_BOOL", Short: "Enable the feature"})
+	env.EInt(EnvVar{Key: "TEST_INT", Short: "Number of workers"})
+	env.EEnum(EnvVar{Key: "TEST_ENUM", Short: "Build mode"}, "debug", "release")
+	env.ERegexp(EnvVar{Key: "TEST_TAG", Short: "Release tag"}, "v[0-9")
+
+	err := env.Err()
+	require.Error(t, err)
+	require.Len(t, trace.Unwrap(err).(trace.Aggregate).Errors(), 4)
+	require.Contains(t, err.Error(), "TEST_BOOL (Enable the feature)")
+	require.Contains(t, err.Error(), "TEST_INT (Number of workers)")
+	require.Contains(t, err.Error(), "TEST_ENUM (Build mode)")
+	require.Contains(t, err.Error(), "TEST_TAG (Release tag): invalid pattern")
+}
+
+func TestValidateReportsMissingAndInvalid(t *testing.T) {
+	env := newEnviron(func() map[string]string {
+		return map[string]string{
+			"TEST_INT": "many",
+		}
+	})
+
+	env.E(EnvVar{Key: "TEST_TOKEN", Short: "Registry token", Required: true, Secret: true})
+	env.E(EnvVar{Key: "TEST_VERSION", Short: "Version", Required: true, Default: "v1.0"})
+	env.EInt(EnvVar{Key: "TEST_INT", Short: "Number of workers"})
+
+	err := env.Validate()
+	require.Error(t, err)
+	require.Len(t, trace.Unwrap(err).(trace.Aggregate).Errors(), 2)
+	require.Contains(t, err.Error(), "TEST_TOKEN (Registry token): required variable is not set")
+	require.Contains(t, err.Error(), "TEST_INT (Number of workers)")
+	require.NotContains(t, err.Error(), "TEST_VERSION")
+}
+
+func TestImportsFromDotenv(t *testing.T) {
+	os.Setenv("MAGNET_TEST_HOME", "/home/test")
+	defer os.Unsetenv("MAGNET_TEST_HOME")
+
+	input := `
+# build defaults
+VERSION=v1.0 # trailing comment
+export ARCH=amd64
+NAME = 'literal ${VERSION}'
+DESC="multi
+line \"value\" for ${ARCH}"
+CACHE=${MAGNET_TEST_HOME}/cache
+PRICE="\$5"
+FALLBACK=${UNDEFINED_VARIABLE:-fallback}
+`
+	env, err := ImportEnvFromDotenvReader(strings.NewReader(input))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"VERSION":  "v1.0",
+		"ARCH":     "amd64",
+		"NAME":     "literal ${VERSION}",
+		"DESC":     "multi\nline \"value\" for amd64",
+		"CACHE":    "/home/test/cache",
+		"PRICE":    "$5",
+		"FALLBACK": "fallback",
+	}, env)
+
+	_, err = ImportEnvFromDotenvReader(strings.NewReader(`KEY="unterminated`))
+	require.Error(t, err)
+}
+
+func TestImportsFromConfig(t *testing.T) {
+	for _, input := range []string{
+		"VERSION: v1.0\nDEBUG: true\nWORKERS: 4\nPLATFORMS: [linux/amd64, linux/arm64]\nGO_VERSION: 1.10\nBUILD_ID: 12345678901234567890\nEMPTY:\n",
+		`{"VERSION": "v1.0", "DEBUG": true, "WORKERS": 4, "PLATFORMS": ["linux/amd64", "linux/arm64"], "GO_VERSION": 1.10, "BUILD_ID": 12345678901234567890, "EMPTY": null}`,
+	} {
+		env, err := ImportEnvFromConfigReader(strings.NewReader(input))
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{
+			"VERSION":    "v1.0",
+			"DEBUG":      "true",
+			"WORKERS":    "4",
+			"PLATFORMS":  "linux/amd64,linux/arm64",
+			"GO_VERSION": "1.10",
+			"BUILD_ID":   "12345678901234567890",
+			"EMPTY":      "",
+		}, env)
+	}
+
+	_, err := ImportEnvFromConfigReader(strings.NewReader("NESTED:\n  KEY: value\n"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "NESTED: expected a scalar value")
+}
+
+func TestLayeredSourcesTrackProvenance(t *testing.T) {
+	env := newEnvironFromSources(
+		EnvSourceOverrides("config", map[string]string{
+			"TEST_VERSION": "v1.0",
+			"TEST_ARCH":    "amd64",
+		}),
+		EnvSourceOverrides("command line", map[string]string{
+			"TEST_VERSION": "v2.0",
+		}),
+	)
+
+	require.Equal(t, "v2.0", env.E(EnvVar{Key: "TEST_VERSION", Default: "v0.1"}))
+	require.Equal(t, "amd64", env.E(EnvVar{Key: "TEST_ARCH"}))
+	require.Equal(t, "/tmp", env.E(EnvVar{Key: "TEST_DIR", Default: "/tmp"}))
+	require.Equal(t, "", env.E(EnvVar{Key: "TEST_UNSET"}))
+
+	vars := env.Env()
+	require.Equal(t, "command line", vars["TEST_VERSION"].Source)
+	require.Equal(t, "config", vars["TEST_ARCH"].Source)
+	require.Equal(t, EnvSourceDefault, vars["TEST_DIR"].Source)
+	require.Equal(t, "", vars["TEST_UNSET"].Source)
+}
+
+func TestProcessEnvironmentIsReadLazily(t *testing.T) {
+	env := newEnvironFromSources(
+		EnvSourceOverrides(EnvSourceMakefileName, map[string]string{
+			"MAGNET_TEST_LAZY": "makefile",
+		}),
+		EnvSourceProcess(),
+	)
+	require.Equal(t, "makefile", env.E(EnvVar{Key: "MAGNET_TEST_LAZY"}))
+
+	os.Setenv("MAGNET_TEST_LAZY", "process")
+	defer os.Unsetenv("MAGNET_TEST_LAZY")
+
+	require.Equal(t, "process", env.E(EnvVar{Key: "MAGNET_TEST_LAZY"}))
+	require.Equal(t, EnvSourceProcessName, env.Env()["MAGNET_TEST_LAZY"].Source)
+}
+
+func TestWriteEnvRedactsSecrets(t *testing.T) {
+	env := newEnvironFromSources(EnvSourceOverrides("config", map[string]string{
+		"TEST_TOKEN":   "s3cr3t",
+		"TEST_VERSION": "it's v1",
+		"TEST_NOTES":   "line1\nline2",
+	}))
+	env.E(EnvVar{Key: "TEST_TOKEN", Short: "Registry token", Secret: true})
+	env.E(EnvVar{Key: "TEST_VERSION", Short: "Version"})
+	env.E(EnvVar{Key: "TEST_NOTES"})
+
+	for _, format := range EnvFormats {
+		var buf bytes.Buffer
+		require.NoError(t, env.WriteEnv(&buf, format))
+		require.NotContains(t, buf.String(), "s3cr3t", format)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, env.WriteEnv(&buf, EnvFormatShell))
+	require.Contains(t, buf.String(), `export TEST_VERSION='it'\''s v1'`)
+
+	buf.Reset()
+	require.NoError(t, env.WriteEnv(&buf, EnvFormatGithub))
+	require.Equal(t, "TEST_NOTES<<MAGNET_EOF\nline1\nline2\nMAGNET_EOF\nTEST_VERSION=it's v1\n", buf.String())
+
+	require.Error(t, env.WriteEnv(&buf, "xml"))
+}
+
+func TestSecretProviders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnet-secrets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "token"), []byte("file-secret\n"), 0600))
+	keyPath := filepath.Join(dir, "key")
+	require.NoError(t, ioutil.WriteFile(keyPath, []byte(strings.Repeat("ab", 32)), 0600))
+	secretsPath := filepath.Join(dir, "secrets.enc")
+	require.NoError(t, EncryptSecretsFile(secretsPath, keyPath, map[string]string{
+		"TEST_ENCRYPTED": "encrypted-secret",
+	}))
+
+	env := newEnvironFromSources()
+	require.Equal(t, "file-secret", env.E(EnvVar{
+		Key:            "TEST_FILE_SECRET",
+		SecretProvider: SecretFromFile(filepath.Join(dir, "token")),
+	}))
+	require.Equal(t, "encrypted-secret", env.E(EnvVar{
+		Key:            "TEST_ENCRYPTED",
+		SecretProvider: SecretFromEncryptedFile(secretsPath, keyPath),
+	}))
+	env.E(EnvVar{
+		Key:            "TEST_MISSING",
+		Short:          "Missing secret",
+		SecretProvider: SecretFromDir(dir),
+		Required:       true,
+	})
+	// optional variables fall back to the default with a warning if the provider fails
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	require.Equal(t, "anonymous", env.E(EnvVar{
+		Key:            "TEST_OPTIONAL",
+		Default:        "anonymous",
+		SecretProvider: SecretFromDir(dir),
+	}))
+	log.SetOutput(os.Stderr)
+	require.Contains(t, logs.String(), "WARNING: Failed to resolve TEST_OPTIONAL from dir:"+dir)
+	// lazy variables are not resolved until used
+	lazy := env.ELazy(EnvVar{
+		Key:            "TEST_LAZY",
+		SecretProvider: SecretFromDir(dir),
+	})
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "TEST_LAZY"), []byte("lazy-secret\n"), 0600))
+	require.Equal(t, "lazy-secret", lazy())
+
+	vars := env.Env()
+	require.True(t, vars["TEST_FILE_SECRET"].Secret)
+	require.Equal(t, "file:"+filepath.Join(dir, "token"), vars["TEST_FILE_SECRET"].Source)
+	err = env.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "TEST_MISSING (Missing secret)")
+	require.NotContains(t, err.Error(), "TEST_OPTIONAL")
+
+	redactor := newSecretsRedactor(env)
+	require.Equal(t, "token=<redacted> <redacted>",
+		string(redactor.redact([]byte("token=file-secret encrypted-secret"))))
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	env := newEnvironFromSources()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		lazy := env.ELazy(EnvVar{
+			Key:            fmt.Sprintf("TEST_LAZY_%v", i),
+			SecretProvider: secretProviderFunc(func(key string) (string, error) { return key, nil }),
+		})
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			require.Equal(t, fmt.Sprintf("TEST_LAZY_%v", i), lazy())
+			env.E(EnvVar{Key: fmt.Sprintf("TEST_OTHER_%v", i)})
+		}(i)
+		go func() {
+			defer wg.Done()
+			env.Snapshot()
+			require.NoError(t, env.Validate())
+		}()
+	}
+	wg.Wait()
+}
+
+type secretProviderFunc func(key string) (string, error)
+
+func (r secretProviderFunc) Name() string {
+	return "func"
+}
+
+func (r secretProviderFunc) Resolve(key string) (string, error) {
+	return r(key)
+}
+
+func TestDeprecatedAliases(t *testing.T) {
+	env := newEnvironFromSources(
+		EnvSourceOverrides("config", map[string]string{
+			"TEST_NEW_REGISTRY": "config.registry",
+		}),
+		EnvSourceOverrides("environment", map[string]string{
+			"TEST_OLD_REGISTRY": "env.registry",
+			"TEST_NEW_ARCH":     "arm64",
+			"TEST_OLD_ARCH":     "amd64",
+		}),
+	)
+
+	// alias in the higher precedence source wins
+	require.Equal(t, "env.registry", env.E(EnvVar{Key: "TEST_NEW_REGISTRY", Aliases: []string{"TEST_OLD_REGISTRY"}}))
+	// within the same source, the variable wins over its alias
+	require.Equal(t, "arm64", env.E(EnvVar{Key: "TEST_NEW_ARCH", Aliases: []string{"TEST_OLD_ARCH"}}))
+
+	require.Equal(t, "env.registry", env.MustGetEnv("TEST_OLD_REGISTRY"))
+	require.Equal(t, "environment (TEST_OLD_REGISTRY)", env.Env()["TEST_NEW_REGISTRY"].Source)
+
+	// the warning is only issued once per variable
+	env.E(EnvVar{Key: "TEST_NEW_REGISTRY", Aliases: []string{"TEST_OLD_REGISTRY"}})
+
+	warnings := env.takeDeprecations()
+	require.Len(t, warnings, 1)
+	require.Contains(t, warnings[0], "TEST_OLD_REGISTRY is deprecated")
+	env.E(EnvVar{Key: "TEST_NEW_REGISTRY", Aliases: []string{"TEST_OLD_REGISTRY"}})
+	require.Empty(t, env.takeDeprecations())
+}
+
+func TestEnvSnapshotDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnet-snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ci := newEnvironFromSources(EnvSourceOverrides("environment", map[string]string{
+		"TEST_VERSION": "v1.0",
+		"TEST_TOKEN":   "s3cr3t",
+	}))
+	ci.E(EnvVar{Key: "TEST_VERSION", Default: "v0.1"})
+	ci.E(EnvVar{Key: "TEST_TOKEN", Secret: true})
+	ci.E(EnvVar{Key: "TEST_ARCH", Default: "amd64"})
+	require.NoError(t, ci.Snapshot().write(filepath.Join(dir, EnvSnapshotFile)))
+
+	laptop := newEnvironFromSources()
+	laptop.E(EnvVar{Key: "TEST_VERSION", Default: "v0.1"})
+	laptop.E(EnvVar{Key: "TEST_ARCH", Default: "amd64"})
+
+	old, err := LoadEnvSnapshot(dir)
+	require.NoError(t, err)
+	require.Equal(t, redacted, old["TEST_TOKEN"].Value)
+
+	changes := DiffEnvSnapshots(old, laptop.Snapshot())
+	require.Len(t, changes, 2)
+	require.Equal(t, "TEST_TOKEN", changes[0].Key)
+	require.Nil(t, changes[0].New)
+	require.Equal(t, "TEST_VERSION", changes[1].Key)
+	require.Equal(t, "v1.0", changes[1].Old.Value)
+	require.Equal(t, "v0.1", changes[1].New.Value)
+	require.Equal(t, EnvSourceDefault, changes[1].New.Source)
+}
+
+func TestImportsFromReaderWithPrefix(t *testing.T) {
+	env, err := ImportEnvFromReaderWithPrefix(strings.NewReader("PRODUCT_VERSION=v1.0\nMAGNET_VERSION=v2.0\n"), "PRODUCT_")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"VERSION": "v1.0"}, env)
+}
+
+func TestNamespacesAndConflicts(t *testing.T) {
+	env := newEnvironFromSources(EnvSourceOverrides("Makefile", map[string]string{
+		"COMMON_VERSION": "v1.0",
+		"VERSION":        "v2.0",
+	}))
+	common := env.Namespace("common", "COMMON_")
+
+	require.Equal(t, "v1.0", common.E(EnvVar{Key: "VERSION", Short: "Helpers version"}))
+	require.Equal(t, "v2.0", env.E(EnvVar{Key: "VERSION", Short: "Product version"}))
+	require.Equal(t, "v1.0", common.MustGetEnv("VERSION"))
+	require.Equal(t, "common", env.Env()["COMMON_VERSION"].Namespace)
+	require.NoError(t, env.Validate())
+
+	// identical definitions do not conflict
+	env.E(EnvVar{Key: "ARCH", Default: "amd64", Short: "Architecture"})
+	env.E(EnvVar{Key: "ARCH", Default: "amd64", Short: "Architecture"})
+	require.NoError(t, env.Validate())
+
+	product := env.Namespace("product", "")
+	product.E(EnvVar{Key: "ARCH", Default: "arm64", Short: "Architecture"})
+	err := env.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `ARCH: conflicting definitions in the global namespace and namespace "product": default "amd64" vs "arm64"`)
+}
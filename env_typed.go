@@ -0,0 +1,242 @@
+package magnet
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+const (
+	// EnvTypeString describes a plain string variable
+	EnvTypeString = "string"
+	// EnvTypeBool describes a boolean variable
+	EnvTypeBool = "bool"
+	// EnvTypeInt describes an integer variable
+	EnvTypeInt = "int"
+	// EnvTypeDuration describes a variable in time.Duration format
+	EnvTypeDuration = "duration"
+	// EnvTypeList describes a comma-separated list variable
+	EnvTypeList = "list"
+	// EnvTypeEnum describes a variable restricted to a set of allowed values
+	EnvTypeEnum = "enum"
+)
+
+// EBool defines a new boolean environment variable specified with e.
+// See Environ.EBool for details
+func EBool(e EnvVar) bool {
+	return env.EBool(e)
+}
+
+// EInt defines a new integer environment variable specified with e.
+// See Environ.EInt for details
+func EInt(e EnvVar) int {
+	return env.EInt(e)
+}
+
+// EDuration defines a new duration environment variable specified with e.
+// See Environ.EDuration for details
+func EDuration(e EnvVar) time.Duration {
+	return env.EDuration(e)
+}
+
+// EList defines a new comma-separated list environment variable specified with e.
+// See Environ.EList for details
+func EList(e EnvVar) []string {
+	return env.EList(e)
+}
+
+// EEnum defines a new environment variable specified with e that is restricted
+// to the given set of allowed values.
+// See Environ.EEnum for details
+func EEnum(e EnvVar, allowed ...string) string {
+	return env.EEnum(e, allowed...)
+}
+
+// ERegexp defines a new string environment variable specified with e
+// that is validated against the given regular expression.
+// See Environ.ERegexp for details
+func ERegexp(e EnvVar, pattern string) string {
+	return env.ERegexp(e, pattern)
+}
+
+// EBool defines a new boolean environment variable specified with e.
+// Accepts 1/0, t/f, true/false, yes/no and on/off (case-insensitive).
+// An unset variable evaluates to false.
+// Invalid values are recorded and reported by Err
+func (r *Environ) EBool(e EnvVar) bool {
+	e.Type = EnvTypeBool
+	value, err := parseBool(r.E(e))
+	r.setInvalid(e, err)
+	return value
+}
+
+// EInt defines a new integer environment variable specified with e.
+// An unset variable evaluates to 0.
+// Invalid values are recorded and reported by Err
+func (r *Environ) EInt(e EnvVar) int {
+	e.Type = EnvTypeInt
+	value := strings.TrimSpace(r.E(e))
+	if value == "" {
+		return 0
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil {
+		err = trace.BadParameter("expected an integer, got %q", value)
+	}
+	r.setInvalid(e, err)
+	return result
+}
+
+// EDuration defines a new duration environment variable specified with e.
+// The value is expected in the format accepted by time.ParseDuration.
+// An unset variable evaluates to 0.
+// Invalid values are recorded and reported by Err
+func (r *Environ) EDuration(e EnvVar) time.Duration {
+	e.Type = EnvTypeDuration
+	value := strings.TrimSpace(r.E(e))
+	if value == "" {
+		return 0
+	}
+	result, err := time.ParseDuration(value)
+	if err != nil {
+		err = trace.BadParameter("expected a duration (e.g. 1m30s), got %q", value)
+	}
+	r.setInvalid(e, err)
+	return result
+}
+
+// EList defines a new comma-separated list environment variable specified with e.
+// Items are trimmed of surrounding whitespace and empty items are dropped.
+// An unset variable evaluates to an empty list
+func (r *Environ) EList(e EnvVar) []string {
+	e.Type = EnvTypeList
+	return parseList(r.E(e))
+}
+
+// EEnum defines a new environment variable specified with e that is restricted
+// to the given set of allowed values.
+// An unset variable evaluates to an empty string.
+// Values not in the allowed set are recorded and reported by Err
+func (r *Environ) EEnum(e EnvVar, allowed ...string) string {
+	if len(allowed) == 0 {
+		panic("enum requires at least one allowed value")
+	}
+	e.Type = EnvTypeEnum
+	e.Allowed = allowed
+	value := r.E(e)
+	if value == "" {
+		return ""
+	}
+	for _, v := range allowed {
+		if v == value {
+			return value
+		}
+	}
+	r.setInvalid(e, trace.BadParameter("expected one of [%v], got %q", strings.Join(allowed, ", "), value))
+	return value
+}
+
+// ERegexp defines a new string environment variable specified with e
+// that is validated against the given regular expression.
+// The pattern is not implicitly anchored.
+// An unset variable evaluates to an empty string.
+// Values not matching the pattern as well as invalid patterns
+// are recorded and reported by Err
+func (r *Environ) ERegexp(e EnvVar, pattern string) string {
+	e.Type = EnvTypeString
+	e.Pattern = pattern
+	value := r.E(e)
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		r.setInvalid(e, trace.BadParameter("invalid pattern %q: %v", pattern, err))
+		return value
+	}
+	if value == "" {
+		return ""
+	}
+	if !re.MatchString(value) {
+		r.setInvalid(e, trace.BadParameter("expected value matching %q, got %q", pattern, value))
+	}
+	return value
+}
+
+// Err returns the aggregated error for all variables registered with
+// an invalid value or nil if all values are valid
+func (r *Environ) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make([]string, 0, len(r.invalid))
+	for key := range r.invalid {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errors []error
+	for _, key := range keys {
+		errors = append(errors, r.invalid[key])
+	}
+	return trace.NewAggregate(errors...)
+}
+
+// TypeInfo describes the type of the variable along with the
+// set of allowed values or the validation pattern, if any.
+// Variables without explicit type are described as strings
+func (e EnvVar) TypeInfo() string {
+	typ := e.Type
+	if typ == "" {
+		typ = EnvTypeString
+	}
+	switch {
+	case len(e.Allowed) != 0:
+		return fmt.Sprintf("%v (%v)", typ, strings.Join(e.Allowed, "|"))
+	case e.Pattern != "":
+		return fmt.Sprintf("%v (/%v/)", typ, e.Pattern)
+	}
+	return typ
+}
+
+// setInvalid records err as the validation error for the variable e.
+// A nil err clears any previously recorded error
+func (r *Environ) setInvalid(e EnvVar, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		delete(r.invalid, e.Key)
+		return
+	}
+	r.invalid[e.Key] = trace.BadParameter("%v: %v", e.describe(), trace.UserMessage(err))
+}
+
+// describe formats the variable key along with its short description
+func (e EnvVar) describe() string {
+	if e.Short == "" {
+		return e.Key
+	}
+	return fmt.Sprintf("%v (%v)", e.Key, e.Short)
+}
+
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "":
+		return false, nil
+	case "1", "t", "true", "y", "yes", "on":
+		return true, nil
+	case "0", "f", "false", "n", "no", "off":
+		return false, nil
+	}
+	return false, trace.BadParameter("expected a boolean (true/false, yes/no, on/off, 1/0), got %q", value)
+}
+
+func parseList(value string) (result []string) {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
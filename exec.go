@@ -19,6 +19,8 @@ type ExecConfig struct {
 	target *MagnetTarget
 	env    map[string]string
 	wd     string
+	stdin  io.Reader
+	stderr io.Writer
 }
 
 // Exec is used to build and run a command on the system.
@@ -58,6 +60,20 @@ func (e *ExecConfig) SetWD(wd string) *ExecConfig {
 	return e
 }
 
+// SetStdin sets the reader the command reads its standard input from instead of os.Stdin.
+func (e *ExecConfig) SetStdin(r io.Reader) *ExecConfig {
+	e.stdin = r
+
+	return e
+}
+
+// SetStderr redirects the stderr of the command to w instead of the target's log output.
+func (e *ExecConfig) SetStderr(w io.Writer) *ExecConfig {
+	e.stderr = w
+
+	return e
+}
+
 // Run runs the provided command
 // based on https://github.com/magefile/mage/blob/310e198ebd9303cd2c876d96e79de954915f60a7/sh/cmd.go#L92
 func (e *ExecConfig) Run(ctx context.Context, cmd string, args ...string) (bool, error) {
@@ -76,7 +92,11 @@ func (e *ExecConfig) Run(ctx context.Context, cmd string, args ...string) (bool,
 		args[i] = os.Expand(args[i], expand)
 	}
 
-	stdout, stderr := outStreams(e.target.vertex.Digest, e.target.root.status)
+	stdout, stderrStream := outStreams(e.target.vertex.Digest, e.target.root.status)
+	var stderr io.Writer = stderrStream
+	if e.stderr != nil {
+		stderr = e.stderr
+	}
 
 	if len(e.env) > 0 {
 		e.target.Println("Env: ", e.env, " Exec: ", fmt.Sprint(cmd, " ", strings.Join(args, " ")))
@@ -84,7 +104,7 @@ func (e *ExecConfig) Run(ctx context.Context, cmd string, args ...string) (bool,
 		e.target.Println("Exec: ", fmt.Sprint(cmd, " ", strings.Join(args, " ")))
 	}
 
-	ran, err := run(ctx, e.env, stdout, stderr, e.wd, cmd, args...)
+	ran, err := run(ctx, e.env, e.stdin, stdout, stderr, e.wd, cmd, args...)
 
 	return ran, trace.Wrap(err)
 }
@@ -93,12 +113,12 @@ func (e *ExecConfig) Run(ctx context.Context, cmd string, args ...string) (bool,
 // Note: output / trace won't be present in magnet logs
 func Output(ctx context.Context, cmd string, args ...string) (string, error) {
 	buf := &bytes.Buffer{}
-	_, err := run(ctx, nil, buf, buf, "", cmd, args...)
+	_, err := run(ctx, nil, nil, buf, buf, "", cmd, args...)
 	return strings.TrimSuffix(buf.String(), "\n"), err
 }
 
 // based on https://github.com/magefile/mage/blob/310e198ebd9303cd2c876d96e79de954915f60a7/sh/cmd.go#L126
-func run(ctx context.Context, env map[string]string, stdout, stderr io.Writer, wd, cmd string, args ...string) (ran bool, err error) {
+func run(ctx context.Context, env map[string]string, stdin io.Reader, stdout, stderr io.Writer, wd, cmd string, args ...string) (ran bool, err error) {
 	c := exec.CommandContext(ctx, cmd, args...)
 	c.Env = os.Environ()
 
@@ -109,6 +129,9 @@ func run(ctx context.Context, env map[string]string, stdout, stderr io.Writer, w
 	c.Stderr = stderr
 	c.Stdout = stdout
 	c.Stdin = os.Stdin
+	if stdin != nil {
+		c.Stdin = stdin
+	}
 	c.Dir = wd
 
 	err = c.Run()
@@ -0,0 +1,204 @@
+package magnet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"github.com/opencontainers/go-digest"
+)
+
+// GitConfig holds configuration for checking out git repositories.
+type GitConfig struct {
+	target *MagnetTarget
+
+	// Dir optionally specifies the directory to check out the repository into.
+	// Defaults to a directory in the cache keyed by the remote and the commit.
+	Dir string
+
+	// Update specifies whether to always fetch from the remote.
+	// By default, the remote is only fetched if the requested ref is missing from the mirror,
+	// so branches are not updated once fetched.
+	Update bool
+}
+
+// GitCheckout describes a checked out git repository
+type GitCheckout struct {
+	// Remote specifies the URL of the remote repository
+	Remote string
+	// Ref specifies the requested ref
+	Ref string
+	// Commit specifies the resolved commit
+	Commit string
+	// Dir specifies the directory with the working tree
+	Dir string
+}
+
+// Git creates a builder for checking out git repositories.
+func (m *MagnetTarget) Git() *GitConfig {
+	return &GitConfig{
+		target: m,
+	}
+}
+
+// SetDir sets the directory to check out the repository into.
+func (c *GitConfig) SetDir(dir string) *GitConfig {
+	c.Dir = dir
+	return c
+}
+
+// SetUpdate sets whether to always fetch from the remote.
+func (c *GitConfig) SetUpdate(update bool) *GitConfig {
+	c.Update = update
+	return c
+}
+
+// Checkout checks out the ref (a commit, tag or branch) of the remote repository.
+//
+// A bare mirror of each remote is maintained in the cache directory and is only fetched
+// if the ref cannot be resolved locally. The working tree is created as a worktree
+// of the mirror and reused if it is already at the resolved commit.
+// Local changes and untracked files in a reused working tree are discarded.
+func (c *GitConfig) Checkout(ctx context.Context, remote, ref string) (checkout *GitCheckout, err error) {
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return nil, trace.BadParameter("invalid git ref %q", ref)
+	}
+
+	t := c.target.Target(fmt.Sprintf("git checkout %v@%v", remote, ref))
+	defer func() { t.Complete(err) }()
+
+	mirror := filepath.Join(t.root.cacheDir(), "git", digest.FromString(remote).Encoded())
+	unlock, err := lockFile(ctx, fmt.Sprintf("%v.lock", mirror))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer unlock()
+
+	fetched := false
+	if _, err := os.Stat(mirror); os.IsNotExist(err) {
+		if err := cloneMirror(ctx, t, remote, mirror); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		fetched = true
+	}
+
+	commit, err := resolveCommit(ctx, mirror, ref)
+	if (err != nil || c.Update) && !fetched {
+		if _, err := t.Exec().SetWD(mirror).Run(ctx, "git", "fetch", "--progress", "--prune", "--tags", "origin"); err != nil {
+			return nil, trace.Wrap(err, "failed to fetch %v", remote)
+		}
+		commit, err = resolveCommit(ctx, mirror, ref)
+	}
+	if err != nil {
+		// the ref might be a commit not reachable from any advertised ref
+		if _, err := t.Exec().SetWD(mirror).Run(ctx, "git", "fetch", "--progress", "origin", ref); err != nil {
+			return nil, trace.Wrap(err, "failed to fetch %v from %v", ref, remote)
+		}
+		commit, err = resolveCommit(ctx, mirror, ref)
+		if err != nil {
+			return nil, trace.NotFound("ref %v not found in %v", ref, remote)
+		}
+	}
+
+	dir := c.Dir
+	if dir == "" {
+		dir = filepath.Join(t.root.cacheDir(), "git-worktrees", fmt.Sprintf("%v-%v", digest.FromString(remote).Encoded()[:12], commit))
+	}
+
+	if head, err := resolveCommit(ctx, dir, "HEAD"); err == nil && head == commit {
+		dirty, err := isDirty(ctx, dir)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if dirty {
+			t.Printlnf("Discarding local changes in %v.", dir)
+			if err := resetWorktree(ctx, t, dir, commit); err != nil {
+				return nil, trace.Wrap(err)
+			}
+		} else {
+			touchCache(dir)
+			t.SetCached(!fetched)
+		}
+	} else if err := addWorktree(ctx, t, mirror, dir, commit); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	t.Printlnf("Checked out %v at %v (commit %v) in %v.", remote, ref, commit, dir)
+	return &GitCheckout{
+		Remote: remote,
+		Ref:    ref,
+		Commit: commit,
+		Dir:    dir,
+	}, nil
+}
+
+// cloneMirror creates a bare mirror of remote at path.
+// The mirror is cloned into a temporary directory first, so an interrupted clone is never used
+func cloneMirror(ctx context.Context, t *MagnetTarget, remote, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	tmp := fmt.Sprintf("%v.tmp", path)
+	if err := os.RemoveAll(tmp); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	if _, err := t.Exec().Run(ctx, "git", "clone", "--progress", "--mirror", "--", remote, tmp); err != nil {
+		_ = os.RemoveAll(tmp)
+		return trace.Wrap(err, "failed to clone %v", remote)
+	}
+	return trace.ConvertSystemError(os.Rename(tmp, path))
+}
+
+// addWorktree checks out commit from the mirror into dir.
+// An existing worktree is updated to the commit
+func addWorktree(ctx context.Context, t *MagnetTarget, mirror, dir, commit string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return trace.Wrap(resetWorktree(ctx, t, dir, commit))
+	}
+	// forget worktrees removed from disk (e.g. by the cache collection)
+	if _, err := t.Exec().SetWD(mirror).Run(ctx, "git", "worktree", "prune"); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	_, err := t.Exec().SetWD(mirror).Run(ctx, "git", "worktree", "add", "--force", "--detach", dir, commit)
+	return trace.Wrap(err)
+}
+
+// resetWorktree checks out commit in the existing worktree at dir
+// discarding all local changes and untracked files
+func resetWorktree(ctx context.Context, t *MagnetTarget, dir, commit string) error {
+	if _, err := t.Exec().SetWD(dir).Run(ctx, "git", "checkout", "--force", "--detach", commit); err != nil {
+		return trace.Wrap(err)
+	}
+	_, err := t.Exec().SetWD(dir).Run(ctx, "git", "clean", "--force", "-d")
+	return trace.Wrap(err)
+}
+
+// isDirty returns true if the working tree at dir has local changes or untracked files
+func isDirty(ctx context.Context, dir string) (bool, error) {
+	var stdout, stderr bytes.Buffer
+	_, err := run(ctx, nil, nil, &stdout, &stderr, dir, "git", "status", "--porcelain")
+	if err != nil {
+		return false, trace.Wrap(err, "failed to query the status of %v: %v", dir, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()) != "", nil
+}
+
+// resolveCommit resolves ref to the commit hash in the repository at dir
+func resolveCommit(ctx context.Context, dir, ref string) (string, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return "", trace.ConvertSystemError(err)
+	}
+	var stdout, stderr bytes.Buffer
+	_, err := run(ctx, nil, nil, &stdout, &stderr, dir, "git", "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return "", trace.NotFound("failed to resolve %v: %v", ref, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
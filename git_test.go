@@ -0,0 +1,73 @@
+package magnet
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/gravitational/trace"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitCheckout(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	remote, err := ioutil.TempDir("", "magnet-git")
+	require.NoError(t, err)
+	defer os.RemoveAll(remote)
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = remote
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+		return string(out)
+	}
+	commit := func(content, tag string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(remote, "file"), []byte(content), 0644))
+		git("add", "file")
+		git("commit", "-m", content)
+		git("tag", tag)
+	}
+	git("init")
+	commit("v1", "v1")
+
+	target, cleanup := newTestTarget(t, Config{})
+	defer cleanup()
+
+	v1, err := target.Git().Checkout(context.TODO(), remote, "v1")
+	require.NoError(t, err)
+	requireFileContent(t, filepath.Join(v1.Dir, "file"), "v1")
+	require.Len(t, v1.Commit, 40)
+
+	reused, err := target.Git().Checkout(context.TODO(), remote, "v1")
+	require.NoError(t, err)
+	require.Equal(t, v1, reused)
+
+	// local changes are discarded when the working tree is reused
+	require.NoError(t, ioutil.WriteFile(filepath.Join(v1.Dir, "file"), []byte("modified"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(v1.Dir, "untracked"), []byte("untracked"), 0644))
+	reused, err = target.Git().Checkout(context.TODO(), remote, "v1")
+	require.NoError(t, err)
+	require.Equal(t, v1, reused)
+	requireFileContent(t, filepath.Join(v1.Dir, "file"), "v1")
+	_, err = os.Stat(filepath.Join(v1.Dir, "untracked"))
+	require.True(t, os.IsNotExist(err))
+
+	// a missing ref is fetched from the remote
+	commit("v2", "v2")
+	v2, err := target.Git().Checkout(context.TODO(), remote, "v2")
+	require.NoError(t, err)
+	requireFileContent(t, filepath.Join(v2.Dir, "file"), "v2")
+	require.NotEqual(t, v1.Commit, v2.Commit)
+
+	_, err = target.Git().Checkout(context.TODO(), remote, "missing")
+	require.Error(t, err)
+
+	_, err = target.Git().Checkout(context.TODO(), remote, "--upload-pack=touch")
+	require.True(t, trace.IsBadParameter(err))
+}
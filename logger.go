@@ -67,6 +67,11 @@ func (s *SolveStatusLogger) start(redactor redactor) {
 	go s.writeLogs()
 }
 
+// writeEnv records the redacted snapshot of the resolved environment into the log directory
+func (s *SolveStatusLogger) writeEnv(snapshot EnvSnapshot) error {
+	return trace.Wrap(snapshot.write(filepath.Join(s.dirReal(), EnvSnapshotFile)))
+}
+
 func (s *SolveStatusLogger) dirReal() string {
 	return filepath.Join(s.baseDir, s.time.Format("20060102150405"))
 }
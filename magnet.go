@@ -41,6 +41,63 @@ type Config struct {
 	// PlainProgress specifies whether the logger uses fancy progress reporting.
 	// Set to true to see streaming output (e.g. on CI)
 	PlainProgress *bool
+
+	// DownloadLockFile optionally specifies the path to the lock file with digests of downloaded files.
+	// If specified, the digest of each downloaded URL is recorded on first download and verified
+	// on every subsequent download.
+	// Set DOWNLOAD_LOCK_REFRESH=true, use Magnet.RefreshDownloadLock or the download:refreshLock target
+	// from the common package to update the recorded digests.
+	// Updates are serialized across processes with the file lock at DownloadLockFile.lock
+	DownloadLockFile string
+
+	// DownloadConcurrency optionally limits the number of concurrent downloads.
+	// Defaults to DefaultDownloadConcurrency
+	DownloadConcurrency int
+
+	// DownloadRewrites optionally lists rules to rewrite download URLs,
+	// e.g. to redirect all downloads to an internal mirror.
+	// The first matching rule is applied.
+	// Rules from DOWNLOAD_REWRITES are appended
+	DownloadRewrites []URLRewrite
+
+	// DownloadMirrors optionally lists mirrors to try in order if the upstream download fails.
+	// Each mirror is a rewrite rule applied to the original URL.
+	// Mirrors from DOWNLOAD_MIRRORS are appended
+	DownloadMirrors []URLRewrite
+
+	// DownloadOffline specifies whether downloads are served only from the cache.
+	// A download of a file missing from the cache fails.
+	// Set DOWNLOAD_OFFLINE=true to enable
+	DownloadOffline bool
+
+	// DownloadHTTP optionally configures the HTTP client for all downloads.
+	// The CA bundle and timeouts default to DOWNLOAD_CA_BUNDLE, DOWNLOAD_CONNECT_TIMEOUT
+	// and DOWNLOAD_IDLE_TIMEOUT
+	DownloadHTTP HTTPConfig
+
+	// DockerHost optionally specifies the address of the Docker Engine API.
+	// Defaults to DOCKER_HOST or DefaultDockerHost
+	DockerHost string
+
+	// DockerTLS optionally configures TLS for the Docker Engine API on a TCP address.
+	// Defaults to DOCKER_CERT_PATH and DOCKER_TLS_VERIFY as used by the docker CLI,
+	// i.e. TLS is only enabled by default if DOCKER_TLS_VERIFY is set
+	DockerTLS *DockerTLSConfig
+
+	// DockerBackend optionally specifies how docker is invoked by default:
+	// DockerBackendCLI (default) or DockerBackendAPI.
+	// Defaults to DOCKER_BACKEND
+	DockerBackend string
+
+	// CacheMaxSize optionally limits the size of the cache directory in bytes.
+	// The least recently used entries are removed to enforce the limit
+	// once a day at Root or explicitly with CacheGC.
+	// Defaults to CACHE_MAX_SIZE
+	CacheMaxSize int64
+
+	// CacheMaxAge optionally specifies the duration after which unused cache entries are removed.
+	// Defaults to CACHE_MAX_AGE
+	CacheMaxAge time.Duration
 }
 
 func (c *Config) checkAndSetDefaults() error {
@@ -68,6 +125,57 @@ func (c *Config) checkAndSetDefaults() error {
 		c.LogDir = DefaultLogDir()
 	}
 
+	rewrites, err := parseURLRewrites(downloadRewrites)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	c.DownloadRewrites = append(c.DownloadRewrites, rewrites...)
+
+	mirrors, err := parseURLRewrites(downloadMirrors)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	c.DownloadMirrors = append(c.DownloadMirrors, mirrors...)
+
+	if downloadOffline {
+		c.DownloadOffline = true
+	}
+
+	if c.DownloadHTTP.CABundle == "" {
+		c.DownloadHTTP.CABundle = downloadCABundle
+	}
+
+	if c.DownloadHTTP.ConnectTimeout == 0 {
+		c.DownloadHTTP.ConnectTimeout = downloadConnectTimeout
+	}
+
+	if c.DownloadHTTP.IdleTimeout == 0 {
+		c.DownloadHTTP.IdleTimeout = downloadIdleTimeout
+	}
+
+	if c.DockerHost == "" {
+		c.DockerHost = dockerHost
+	}
+
+	if c.DockerTLS == nil {
+		c.DockerTLS = defaultDockerTLS()
+	}
+
+	if c.DockerBackend == "" {
+		c.DockerBackend = dockerBackend
+	}
+
+	if c.CacheMaxSize == 0 {
+		c.CacheMaxSize, err = parseSize(cacheMaxSize)
+		if err != nil {
+			return trace.Wrap(err, "invalid CACHE_MAX_SIZE")
+		}
+	}
+
+	if c.CacheMaxAge == 0 {
+		c.CacheMaxAge = cacheMaxAge
+	}
+
 	if c.ModulePath != "" {
 		return nil
 	}
@@ -104,6 +212,23 @@ type Magnet struct {
 	// cancel cancels the logger process
 	cancel         context.CancelFunc
 	initOutputOnce sync.Once
+
+	dlLockOnce sync.Once
+	dlLock     *downloadLock
+	dlLockErr  error
+
+	dlManagerOnce sync.Once
+	dlManager     *downloadManager
+
+	httpClients httpClients
+
+	dockerOnce      sync.Once
+	dockerClient    *DockerClient
+	dockerClientErr error
+
+	rawProgressMu sync.Mutex
+	// rawProgress caches whether docker build commands support the rawjson progress format
+	rawProgress map[string]bool
 }
 
 // MagnetTarget describes a child logging target
@@ -124,6 +249,10 @@ func Root(c Config) (*Magnet, error) {
 		return nil, trace.Wrap(err)
 	}
 
+	if err := env.Validate(); err != nil {
+		return nil, trace.Wrap(err, "invalid configuration")
+	}
+
 	statusLogger, err := newSolveStatusLogger(c.LogDir)
 	if err != nil {
 		return nil, trace.Wrap(err)
@@ -146,33 +275,31 @@ func Root(c Config) (*Magnet, error) {
 		cancel:       cancel,
 	}
 	root.root.root = root
+
+	// the cache is collected on a best-effort basis, so don't fail the build
+	_ = root.collectCache(ctx)
+
 	return root, nil
 }
 
 // root specifies the Magnet instance singleton
 var root *Magnet
 
-func newSecretsRedactor(env map[string]EnvVar) secretsRedactor {
-	var secrets []EnvVar
-	for _, value := range env {
-		if value.Secret {
-			secrets = append(secrets, value)
-		}
-	}
-	return secretsRedactor{secrets: secrets}
+func newSecretsRedactor(env *Environ) secretsRedactor {
+	return secretsRedactor{env: env}
 }
 
 // secretsRedactor redacts literal secrets in a text stream.
+// Secrets are queried on each invocation to also redact the secrets
+// registered after the output has started.
 // Implements redactor
 type secretsRedactor struct {
-	secrets []EnvVar
+	env *Environ
 }
 
 func (r secretsRedactor) redact(s []byte) []byte {
-	for _, secret := range r.secrets {
-		if len(secret.Value) > 0 {
-			s = bytes.ReplaceAll(s, []byte(secret.Value), []byte("<redacted>"))
-		}
+	for _, secret := range r.env.secretValues() {
+		s = bytes.ReplaceAll(s, []byte(secret), []byte(redacted))
 	}
 	return s
 }
@@ -180,6 +307,8 @@ func (r secretsRedactor) redact(s []byte) []byte {
 // Shutdown indicates that the program is exiting, and we should shutdown the progressui
 //  if it's currently running
 func (m *Magnet) Shutdown() {
+	// update the snapshot to include variables registered after the output has started
+	_ = m.statusLogger.writeEnv(env.Snapshot())
 	close(m.status)
 	m.cancel()
 	m.wg.Wait()
@@ -187,6 +316,7 @@ func (m *Magnet) Shutdown() {
 
 func (m *Magnet) Target(name string) *MagnetTarget {
 	m.initOutput()
+	m.reportDeprecations()
 	return m.root.newTarget(&progressui.Vertex{
 		Digest: digest.FromString(name),
 		Name:   name,
@@ -195,6 +325,7 @@ func (m *Magnet) Target(name string) *MagnetTarget {
 
 func (m *MagnetTarget) Target(name string) *MagnetTarget {
 	m.root.initOutput()
+	m.reportDeprecations()
 	return m.newTarget(&progressui.Vertex{
 		Digest: digest.FromString(name),
 		Name:   name,
@@ -227,8 +358,11 @@ func (c Config) AbsCacheDir() (path string) {
 // initOutput starts the internal progress logging process
 func (m *Magnet) initOutput() {
 	m.initOutputOnce.Do(func() {
-		redactor := newSecretsRedactor(env.env)
+		redactor := newSecretsRedactor(env)
 		m.statusLogger.start(redactor)
+		// the environment log is purely informational, so don't fail the build
+		_ = m.statusLogger.writeEnv(env.Snapshot())
+		m.reportDeprecations()
 
 		if m.PrintConfig {
 			m.printHeader()
@@ -256,6 +390,38 @@ func (m *Magnet) initOutput() {
 	})
 }
 
+// reportDeprecations outputs the warnings about deprecated environment
+// variables in use as a separate task
+func (m *Magnet) reportDeprecations() {
+	warnings := env.takeDeprecations()
+	if len(warnings) == 0 {
+		return
+	}
+
+	t := m.root.newTarget(&progressui.Vertex{
+		Digest: digest.FromString("deprecated-environment"),
+		Name:   "deprecated environment",
+	})
+	_, stderr := outStreams(t.vertex.Digest, m.status)
+	for _, warning := range warnings {
+		fmt.Fprintln(stderr, "WARNING:", warning)
+	}
+	t.Complete(nil)
+}
+
+// reportDeprecations outputs the warnings about deprecated environment
+// variables used after the output has started to the target log
+func (m *MagnetTarget) reportDeprecations() {
+	warnings := env.takeDeprecations()
+	if len(warnings) == 0 {
+		return
+	}
+	_, stderr := outStreams(m.vertex.Digest, m.root.status)
+	for _, warning := range warnings {
+		fmt.Fprintln(stderr, "WARNING:", warning)
+	}
+}
+
 func defaultCacheDir() string {
 	if runtime.GOOS != "linux" {
 		return ""
@@ -276,6 +442,7 @@ func (c Config) cacheDir() string {
 
 // Complete marks the current task as complete.
 func (m *MagnetTarget) Complete(err error) {
+	m.reportDeprecations()
 	now := time.Now()
 	m.vertex.Completed = &now
 	m.vertex.Cached = m.cached
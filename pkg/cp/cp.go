@@ -39,6 +39,65 @@ func Copy(c Config) error {
 	return trace.Wrap(CopyFile(c.Source, c.Destination))
 }
 
+// WalkFunc is called by Walk for each file selected by the copy configuration.
+// src is the path of the source file and rel the path relative to the destination,
+// which is empty for the source itself
+type WalkFunc func(src, rel string, fi os.FileInfo) error
+
+// Walk calls fn for each file, directory and symlink that matches the include/exclude patterns
+// without copying anything. Directories are visited before their contents.
+// Symlinks are not followed
+func Walk(c Config, fn WalkFunc) error {
+	err := c.checkAndSetDefaults()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	sfi, err := os.Lstat(c.Source)
+	if err != nil {
+		return trace.ConvertSystemError(err)
+	}
+
+	if err := fn(c.Source, "", sfi); err != nil || !sfi.IsDir() {
+		return trace.Wrap(err)
+	}
+
+	return trace.Wrap(c.walkDir(c.Source, "", fn))
+}
+
+func (c Config) walkDir(src, rel string, fn WalkFunc) error {
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return trace.ConvertSystemError(err)
+	}
+
+	for _, entry := range entries {
+		sourcePath := filepath.Join(src, entry.Name())
+		relPath := filepath.Join(rel, entry.Name())
+
+		filtered, err := c.checkIsFiltered(sourcePath)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+
+		if filtered {
+			continue
+		}
+
+		if err := fn(sourcePath, relPath, entry); err != nil {
+			return trace.Wrap(err)
+		}
+
+		if entry.IsDir() {
+			if err := c.walkDir(sourcePath, relPath, fn); err != nil {
+				return trace.Wrap(err)
+			}
+		}
+	}
+
+	return nil
+}
+
 // copyDir
 // based on https://stackoverflow.com/questions/51779243/copy-a-folder-in-go
 func (c Config) copyDir(src, dst string) error {
@@ -0,0 +1,276 @@
+package magnet
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gravitational/trace"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// SecretProvider resolves values of secret variables from an external source
+type SecretProvider interface {
+	// Name describes the provider in the help output and logs
+	Name() string
+	// Resolve returns the value of the secret variable with the specified key
+	Resolve(key string) (value string, err error)
+}
+
+// RegisterSecret registers the literal value to be redacted from all log output
+func RegisterSecret(value string) {
+	env.RegisterSecret(value)
+}
+
+// RegisterSecret registers the literal value to be redacted from all log output
+func (r *Environ) RegisterSecret(value string) {
+	if value == "" {
+		return
+	}
+	r.secretsMu.Lock()
+	defer r.secretsMu.Unlock()
+	for _, secret := range r.secrets {
+		if secret == value {
+			return
+		}
+	}
+	r.secrets = append(r.secrets, value)
+}
+
+// secretValues returns the list of all registered secret values
+func (r *Environ) secretValues() []string {
+	r.secretsMu.Lock()
+	defer r.secretsMu.Unlock()
+	return append([]string(nil), r.secrets...)
+}
+
+// SecretFromFile returns a provider that reads the secret from the file at path.
+// Trailing newlines are removed from the value
+func SecretFromFile(path string) SecretProvider {
+	return fileSecretProvider{path: path}
+}
+
+// SecretFromDir returns a provider that reads secrets from files named after the variable key
+// in the directory dir (e.g. Docker secrets mounted under /run/secrets).
+// Trailing newlines are removed from the value
+func SecretFromDir(dir string) SecretProvider {
+	return dirSecretProvider{dir: dir}
+}
+
+// SecretFromCommand returns a provider that obtains the secret as the output of the specified
+// command (e.g. `pass show build/token`).
+// Trailing newlines are removed from the value
+func SecretFromCommand(cmd string, args ...string) SecretProvider {
+	return commandSecretProvider{cmd: cmd, args: args}
+}
+
+// SecretFromEncryptedFile returns a provider that reads secrets from the file at path
+// encrypted with the key from keyPath.
+// See EncryptSecretsFile for details on the file format
+func SecretFromEncryptedFile(path, keyPath string) SecretProvider {
+	return &encryptedFileSecretProvider{path: path, keyPath: keyPath}
+}
+
+// EncryptSecretsFile writes the secrets as a file at path encrypted with the key from keyPath.
+// The key file is expected to contain a hex-encoded 256-bit key, which can be generated with:
+//
+//	openssl rand -hex 32
+//
+// The secrets are stored as a YAML mapping of variable keys to values encrypted
+// with AES-256-GCM and encoded with base64
+func EncryptSecretsFile(path, keyPath string, secrets map[string]string) error {
+	key, err := readSecretsKey(keyPath)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	plaintext, err := yaml.Marshal(secrets)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	aead, err := newSecretsCipher(key)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return trace.Wrap(err)
+	}
+	ciphertext := aead.Seal(nonce, nonce, plaintext, nil)
+	encoded := base64.StdEncoding.EncodeToString(ciphertext)
+	return trace.ConvertSystemError(ioutil.WriteFile(path, []byte(encoded+"\n"), 0600))
+}
+
+// resolveSecret resolves the value of the secret variable e using its provider.
+func resolveSecret(e EnvVar) (value string, err error) {
+	value, err = e.SecretProvider.Resolve(e.Key)
+	if err != nil {
+		return "", trace.Wrap(err, "failed to resolve secret from %v", e.SecretProvider.Name())
+	}
+	return value, nil
+}
+
+// resolvePending resolves the value of the variable given with key from its
+// secret provider if it has not been resolved yet.
+// If the provider fails, optional variables fall back to their default with a warning
+// while errors for required variables are recorded and reported by Validate
+func (r *Environ) resolvePending(key string) {
+	if !r.pending[key] {
+		return
+	}
+	delete(r.pending, key)
+	e := r.env[key]
+	value, err := resolveSecret(e)
+	switch {
+	case err == nil:
+		e.Value, e.Source = value, e.SecretProvider.Name()
+		r.RegisterSecret(value)
+		r.env[key] = e
+	case e.Required:
+		r.secretErrors[key] = trace.BadParameter("%v: %v", e.describe(), trace.UserMessage(err))
+	default:
+		log.Printf("WARNING: Failed to resolve %v from %v, using the default: %v.\n",
+			e.Key, e.SecretProvider.Name(), trace.UserMessage(err))
+	}
+}
+
+type fileSecretProvider struct {
+	path string
+}
+
+func (r fileSecretProvider) Name() string {
+	return fmt.Sprint("file:", r.path)
+}
+
+func (r fileSecretProvider) Resolve(string) (string, error) {
+	return readSecretFile(r.path)
+}
+
+type dirSecretProvider struct {
+	dir string
+}
+
+func (r dirSecretProvider) Name() string {
+	return fmt.Sprint("dir:", r.dir)
+}
+
+func (r dirSecretProvider) Resolve(key string) (string, error) {
+	return readSecretFile(filepath.Join(r.dir, key))
+}
+
+type commandSecretProvider struct {
+	cmd  string
+	args []string
+}
+
+func (r commandSecretProvider) Name() string {
+	return fmt.Sprint("command:", r.cmd)
+}
+
+func (r commandSecretProvider) Resolve(string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	_, err := run(context.TODO(), nil, nil, &stdout, &stderr, "", r.cmd, r.args...)
+	if err != nil {
+		// only include stderr, the output might contain parts of the secret
+		return "", trace.Wrap(err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
+
+type encryptedFileSecretProvider struct {
+	path    string
+	keyPath string
+
+	once    sync.Once
+	secrets map[string]string
+	err     error
+}
+
+func (r *encryptedFileSecretProvider) Name() string {
+	return fmt.Sprint("encrypted:", r.path)
+}
+
+func (r *encryptedFileSecretProvider) Resolve(key string) (string, error) {
+	r.once.Do(func() {
+		r.secrets, r.err = r.decrypt()
+	})
+	if r.err != nil {
+		return "", trace.Wrap(r.err)
+	}
+	value, ok := r.secrets[key]
+	if !ok {
+		return "", trace.NotFound("secret %v not found in %v", key, r.path)
+	}
+	return value, nil
+}
+
+func (r *encryptedFileSecretProvider) decrypt() (map[string]string, error) {
+	key, err := readSecretsKey(r.keyPath)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	encoded, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, trace.Wrap(err, "invalid secrets file %v", r.path)
+	}
+	aead, err := newSecretsCipher(key)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, trace.BadParameter("invalid secrets file %v", r.path)
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, trace.AccessDenied("failed to decrypt secrets file %v", r.path)
+	}
+	var secrets map[string]string
+	if err := yaml.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, trace.Wrap(err, "invalid secrets file %v", r.path)
+	}
+	return secrets, nil
+}
+
+func readSecretFile(path string) (string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", trace.ConvertSystemError(err)
+	}
+	return strings.TrimRight(string(buf), "\r\n"), nil
+}
+
+func readSecretsKey(path string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(key) != 32 {
+		return nil, trace.BadParameter("expected a hex-encoded 256-bit key in %v", path)
+	}
+	return key, nil
+}
+
+func newSecretsCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, trace.Wrap(err)
+}